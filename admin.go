@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"strconv"
+	"sync"
+)
+
+// drainSet holds upstreams taken out of rotation via admin API
+type drainSet struct {
+	mu      sync.RWMutex
+	drained map[*url.URL]bool
+}
+
+func newDrainSet() *drainSet {
+	return &drainSet{drained: make(map[*url.URL]bool)}
+}
+
+func (d *drainSet) isDrained(u *url.URL) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.drained[u]
+}
+
+func (d *drainSet) set(u *url.URL, drained bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if drained {
+		d.drained[u] = true
+	} else {
+		delete(d.drained, u)
+	}
+}
+
+// active returns targets which are not drained
+func (d *drainSet) active(targets []*url.URL) []*url.URL {
+	var active []*url.URL
+	for _, t := range targets {
+		if !d.isDrained(t) {
+			active = append(active, t)
+		}
+	}
+	return active
+}
+
+// findUpstream finds upstream by its URL without credentials or with redacted password as it is logged,
+// so credentials never have to be passed to admin API
+func findUpstream(urls []*url.URL, s string) (*url.URL, bool) {
+	for _, u := range urls {
+		public := *u
+		public.User = nil
+		if public.String() == s || u.Redacted() == s {
+			return u, true
+		}
+	}
+	return nil, false
+}
+
+func adminHandler(urls []*url.URL, drains *drainSet, m *maintenance, profiling bool) http.Handler {
+	toggle := func(drained bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				w.Header().Set("Allow", http.MethodPost)
+				http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+				return
+			}
+			u, ok := findUpstream(urls, r.URL.Query().Get("upstream"))
+			if !ok {
+				http.Error(w, "Unknown upstream", http.StatusNotFound)
+				return
+			}
+			drains.set(u, drained)
+			l.Printf("Upstream %s draining = %v\n", u.Redacted(), drained)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/admin/drain", toggle(true))
+	mux.Handle("/admin/undrain", toggle(false))
+	mux.HandleFunc("/admin/maintenance", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		on, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		if err != nil {
+			http.Error(w, "enabled must be true or false", http.StatusBadRequest)
+			return
+		}
+		m.set(on)
+		l.Printf("Maintenance = %v\n", on)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	if profiling {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	return mux
+}
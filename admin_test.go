@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestDrainStopsAndResumesTraffic(t *testing.T) {
+	first, second := namedBackend("first"), namedBackend("second")
+	defer first.Close()
+	defer second.Close()
+	urls := backendURLs(t, first, second)
+	c := testConfig()
+	c.Drains = newDrainSet()
+	proxy := newProxy(urls, c)
+	admin := adminHandler(urls, c.Drains, nil, false)
+	servedBy := func() map[string]int {
+		served := make(map[string]int)
+		for i := 0; i < 20; i++ {
+			_, body := serve(proxy, httptest.NewRequest(http.MethodGet, "/", nil))
+			served[body]++
+		}
+		return served
+	}
+
+	resp, _ := serve(admin, httptest.NewRequest(http.MethodPost, "/admin/drain?upstream="+first.URL, nil))
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("drain: status = %d, want 204", resp.StatusCode)
+	}
+	if served := servedBy(); served["first"] > 0 {
+		t.Errorf("drained upstream served %d requests", served["first"])
+	}
+
+	serve(admin, httptest.NewRequest(http.MethodPost, "/admin/undrain?upstream="+first.URL, nil))
+	if served := servedBy(); served["first"] == 0 {
+		t.Error("undrained upstream doesn't get requests")
+	}
+
+	if resp, _ := serve(admin, httptest.NewRequest(http.MethodPost, "/admin/drain?upstream=http://unknown", nil)); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown upstream: status = %d, want 404", resp.StatusCode)
+	}
+	if resp, _ := serve(admin, httptest.NewRequest(http.MethodGet, "/admin/drain?upstream="+first.URL, nil)); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET: status = %d, want 405", resp.StatusCode)
+	}
+}
+
+func TestDrainUpstreamWithCredentials(t *testing.T) {
+	targets := arrayFlags{"http://svc:secret@a:8080", "http://b:8080"}
+	urls, err := targets.toURLs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	drains := newDrainSet()
+	admin := adminHandler(urls, drains, nil, false)
+
+	for _, upstream := range []string{"http://a:8080", "http://svc:xxxxx@a:8080"} {
+		drains.set(urls[0], false)
+		if resp, _ := serve(admin, httptest.NewRequest(http.MethodPost, "/admin/drain?upstream="+url.QueryEscape(upstream), nil)); resp.StatusCode != http.StatusNoContent {
+			t.Errorf("%s: status = %d, want 204", upstream, resp.StatusCode)
+		}
+		if active := drains.active(urls); len(active) != 1 || active[0] != urls[1] {
+			t.Errorf("%s: active upstreams = %v, want credentialed upstream drained", upstream, active)
+		}
+	}
+	if resp, _ := serve(admin, httptest.NewRequest(http.MethodPost, "/admin/drain?upstream="+url.QueryEscape("http://other:secret@a:8080"), nil)); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("upstream with wrong credentials: status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestPprofOnAdminPortOnly(t *testing.T) {
+	backend := namedBackend("upstream")
+	defer backend.Close()
+	urls := backendURLs(t, backend)
+
+	for _, tt := range []struct {
+		profiling bool
+		want      int
+	}{
+		{true, http.StatusOK},
+		{false, http.StatusNotFound},
+	} {
+		admin := adminHandler(urls, newDrainSet(), newMaintenance(""), tt.profiling)
+		for _, path := range []string{"/debug/pprof/", "/debug/pprof/cmdline"} {
+			if resp, _ := serve(admin, httptest.NewRequest(http.MethodGet, path, nil)); resp.StatusCode != tt.want {
+				t.Errorf("pprof = %v: admin %s status = %d, want %d", tt.profiling, path, resp.StatusCode, tt.want)
+			}
+		}
+	}
+	if _, body := serve(newProxy(urls, testConfig()), httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil)); body != "upstream" {
+		t.Errorf("proxy listener answers /debug/pprof/ with %q, want it proxied", body)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Balancer picks an upstream out of non-empty list of available ones
+type Balancer interface {
+	Pick(targets []*url.URL) *url.URL
+}
+
+// newBalancer builds balancer for strategy which picks upstreams using rnd, so the sequence of picks is reproducible with a fixed seed
+func newBalancer(strategy string, urls []*url.URL, weights string, rnd *lockedRand) (Balancer, error) {
+	switch strategy {
+	case "random":
+		return randomBalancer{rnd}, nil
+	case "weighted":
+		return newWeightedBalancer(urls, weights, rnd)
+	case "p2c":
+		return newP2CBalancer(rnd), nil
+	case "failover":
+		return failoverBalancer{}, nil
+	default:
+		return nil, fmt.Errorf("unknown strategy %q", strategy)
+	}
+}
+
+// lockedRand is a random source safe for concurrent use
+type lockedRand struct {
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+func newLockedRand(seed int64) *lockedRand {
+	return &lockedRand{rnd: rand.New(rand.NewSource(seed))}
+}
+
+func (r *lockedRand) Intn(n int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rnd.Intn(n)
+}
+
+type randomBalancer struct {
+	rnd *lockedRand
+}
+
+func (b randomBalancer) Pick(targets []*url.URL) *url.URL {
+	return targets[b.rnd.Intn(len(targets))]
+}
+
+// failoverBalancer picks the first available upstream in the order they are listed,
+// so the rest of them are used only when preceding ones are unhealthy or drained
+type failoverBalancer struct{}
+
+func (failoverBalancer) Pick(targets []*url.URL) *url.URL {
+	return targets[0]
+}
+
+// weightedBalancer picks upstreams randomly proportionally to their weights,
+// weights are renormalized among the passed targets so unavailable upstreams don't skew the distribution,
+// upstreams without configured weight like route and canary ones weigh 1
+type weightedBalancer struct {
+	weights map[*url.URL]int
+	rnd     *lockedRand
+}
+
+// newWeightedBalancer parses comma separated weights listed in the same order as urls, every weight defaults to 1
+func newWeightedBalancer(urls []*url.URL, weights string, rnd *lockedRand) (*weightedBalancer, error) {
+	b := &weightedBalancer{weights: make(map[*url.URL]int), rnd: rnd}
+	for _, u := range urls {
+		b.weights[u] = 1
+	}
+	if len(weights) == 0 {
+		return b, nil
+	}
+
+	fields := strings.Split(weights, ",")
+	if len(fields) != len(urls) {
+		return nil, fmt.Errorf("%d weights are specified for %d upstreams", len(fields), len(urls))
+	}
+	for i, f := range fields {
+		w, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil {
+			return nil, err
+		}
+		if w <= 0 {
+			return nil, fmt.Errorf("weight of %s must be positive", urls[i].Redacted())
+		}
+		b.weights[urls[i]] = w
+	}
+	return b, nil
+}
+
+func (b *weightedBalancer) Pick(targets []*url.URL) *url.URL {
+	total := 0
+	for _, t := range targets {
+		total += b.weight(t)
+	}
+	n := b.rnd.Intn(total)
+	for _, t := range targets {
+		n -= b.weight(t)
+		if n < 0 {
+			return t
+		}
+	}
+	return targets[len(targets)-1]
+}
+
+func (b *weightedBalancer) weight(u *url.URL) int {
+	if w, ok := b.weights[u]; ok {
+		return w
+	}
+	return 1
+}
+
+// Smoothing factor of upstream latency moving average, higher values favor recent responses
+const latencyEWMAAlpha = 0.3
+
+// latencyObserver is implemented by balancers which take upstream response time into account
+type latencyObserver interface {
+	observe(u *url.URL, d time.Duration)
+}
+
+// p2cBalancer picks two random upstreams and prefers the one with lower exponentially weighted moving average
+// of response time, upstreams without observed responses are preferred so they get a chance to be measured
+type p2cBalancer struct {
+	mu        sync.Mutex
+	latencies map[*url.URL]float64
+	rnd       *lockedRand
+}
+
+func newP2CBalancer(rnd *lockedRand) *p2cBalancer {
+	return &p2cBalancer{latencies: make(map[*url.URL]float64), rnd: rnd}
+}
+
+func (b *p2cBalancer) Pick(targets []*url.URL) *url.URL {
+	if len(targets) == 1 {
+		return targets[0]
+	}
+	i := b.rnd.Intn(len(targets))
+	j := b.rnd.Intn(len(targets) - 1)
+	if j >= i {
+		j++
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.latencies[targets[j]] < b.latencies[targets[i]] {
+		return targets[j]
+	}
+	return targets[i]
+}
+
+func (b *p2cBalancer) observe(u *url.URL, d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	prev, ok := b.latencies[u]
+	if !ok {
+		b.latencies[u] = float64(d)
+		return
+	}
+	b.latencies[u] = latencyEWMAAlpha*float64(d) + (1-latencyEWMAAlpha)*prev
+}
+
+const upstreamIndexHeader = "X-Upstream-Index"
+
+// upstreamOverrideMiddleware pins request to an upstream with index passed in X-Upstream-Index header
+func upstreamOverrideMiddleware(next http.Handler, urls []*url.URL) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := r.Header.Get(upstreamIndexHeader)
+		if len(value) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		i, err := strconv.Atoi(value)
+		if err != nil || i < 0 || i >= len(urls) {
+			http.Error(w, fmt.Sprintf("%s must be in range [0, %d]", upstreamIndexHeader, len(urls)-1), http.StatusBadRequest)
+			return
+		}
+		r.Header.Del(upstreamIndexHeader)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), overrideKey, urls[i])))
+	})
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testURLs(t *testing.T, ss ...string) []*url.URL {
+	t.Helper()
+	var urls []*url.URL
+	for _, s := range ss {
+		u, err := url.Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		urls = append(urls, u)
+	}
+	return urls
+}
+
+func TestWeightedBalancerSkipsEjectedUpstreams(t *testing.T) {
+	urls := testURLs(t, "http://heavy:8080", "http://light:8080")
+	c := testConfig()
+	var err error
+	c.Balancer, err = newWeightedBalancer(urls, "3,1", newLockedRand(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Breakers = newBreakers(urls, 0.5, time.Minute, time.Minute)
+
+	counts := make(map[*url.URL]int)
+	for i := 0; i < 4000; i++ {
+		counts[c.loadBalance(urls)]++
+	}
+	if ratio := float64(counts[urls[0]]) / float64(counts[urls[1]]); ratio < 2.5 || ratio > 3.5 {
+		t.Errorf("heavy to light ratio = %.2f, want about 3", ratio)
+	}
+
+	for i := 0; i < breakerMinRequests; i++ {
+		c.Breakers[urls[0]].record(false)
+	}
+	for i := 0; i < 100; i++ {
+		if u := c.loadBalance(urls); u != urls[1] {
+			t.Fatalf("ejected upstream %s is picked", u)
+		}
+	}
+}
+
+func TestUpstreamOverrideHeader(t *testing.T) {
+	first, second := namedBackend("first"), namedBackend("second")
+	defer first.Close()
+	defer second.Close()
+	urls := backendURLs(t, first, second)
+	proxy := upstreamOverrideMiddleware(newProxy(urls, testConfig()), urls)
+
+	for i := 0; i < 10; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(upstreamIndexHeader, "1")
+		if _, body := serve(proxy, req); body != "second" {
+			t.Fatalf("request pinned to upstream 1 is served by %s", body)
+		}
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(upstreamIndexHeader, "2")
+	if resp, _ := serve(proxy, req); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("out of range index: status = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestP2CPrefersFastUpstream(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("slow"))
+	}))
+	defer slow.Close()
+	fast := namedBackend("fast")
+	defer fast.Close()
+	c := testConfig()
+	c.Balancer = newP2CBalancer(newLockedRand(1))
+	proxy := newProxy(backendURLs(t, slow, fast), c)
+
+	served := make(map[string]int)
+	for i := 0; i < 50; i++ {
+		_, body := serve(proxy, httptest.NewRequest(http.MethodGet, "/", nil))
+		served[body]++
+	}
+	if served["slow"] > 5 {
+		t.Errorf("slow upstream served %d of 50 requests, want it to be avoided after being measured", served["slow"])
+	}
+}
+
+func TestFailoverToSecondaryAndBack(t *testing.T) {
+	var down atomic.Bool
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("primary"))
+	}))
+	defer primary.Close()
+	secondary := namedBackend("secondary")
+	defer secondary.Close()
+	urls := backendURLs(t, primary, secondary)
+	c := testConfig()
+	c.Balancer = failoverBalancer{}
+	c.Breakers = newBreakers(urls, 0.5, time.Minute, 50*time.Millisecond)
+	proxy := newProxy(urls, c)
+	expect := func(stage, want string) {
+		t.Helper()
+		for i := 0; i < 5; i++ {
+			if _, body := serve(proxy, httptest.NewRequest(http.MethodGet, "/", nil)); body != want {
+				t.Fatalf("%s: request is served by %q, want %q", stage, body, want)
+			}
+		}
+	}
+
+	expect("healthy primary", "primary")
+	down.Store(true)
+	for i := 0; i < breakerMinRequests; i++ {
+		serve(proxy, httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+	expect("ejected primary", "secondary")
+	down.Store(false)
+	time.Sleep(50 * time.Millisecond)
+	expect("recovered primary", "primary")
+}
+
+func TestBalancerSeedDeterminism(t *testing.T) {
+	urls := testURLs(t, "http://a:8080", "http://b:8080", "http://c:8080")
+	for _, strategy := range []string{"random", "weighted", "p2c"} {
+		picks := func(seed int64) []*url.URL {
+			b, err := newBalancer(strategy, urls, "", newLockedRand(seed))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var seq []*url.URL
+			for i := 0; i < 20; i++ {
+				seq = append(seq, b.Pick(urls))
+			}
+			return seq
+		}
+		first, second, other := picks(42), picks(42), picks(7)
+		same, differs := true, false
+		for i := range first {
+			same = same && first[i] == second[i]
+			differs = differs || first[i] != other[i]
+		}
+		if !same {
+			t.Errorf("%s: sequences picked with the same seed differ", strategy)
+		}
+		if !differs {
+			t.Errorf("%s: sequences picked with different seeds are equal", strategy)
+		}
+	}
+
+	b, _ := newBalancer("random", urls, "", newLockedRand(1))
+	var seq []string
+	for i := 0; i < 8; i++ {
+		seq = append(seq, b.Pick(urls).Hostname())
+	}
+	if got, want := strings.Join(seq, ""), "caccbabc"; got != want {
+		t.Errorf("random balancer with seed 1 picked %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// blockPathMiddleware responds with 404 to requests with path equal to or nested under one of prefixes,
+// so they never reach upstreams, path is cleaned before matching to prevent bypassing with //, /./ or /../
+func blockPathMiddleware(next http.Handler, prefixes []string, ignoreCase bool) http.Handler {
+	for i, p := range prefixes {
+		prefixes[i] = strings.TrimSuffix(p, "/")
+		if ignoreCase {
+			prefixes[i] = strings.ToLower(prefixes[i])
+		}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := path.Clean("/" + r.URL.Path)
+		if ignoreCase {
+			p = strings.ToLower(p)
+		}
+		for _, prefix := range prefixes {
+			if p == prefix || strings.HasPrefix(p, prefix+"/") {
+				http.NotFound(w, r)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
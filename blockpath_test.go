@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestBlockPath(t *testing.T) {
+	var hits atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Write([]byte("upstream"))
+	}))
+	defer backend.Close()
+	proxy := newProxy(backendURLs(t, backend), testConfig())
+
+	for _, tt := range []struct {
+		ignoreCase bool
+		path       string
+		blocked    bool
+	}{
+		{false, "/internal", true},
+		{false, "/internal/metrics", true},
+		{false, "/admin/", true},
+		{false, "//internal/./metrics", true},
+		{false, "/public/../admin/users", true},
+		{false, "/internals", false},
+		{false, "/api/internal", false},
+		{false, "/Internal", false},
+		{true, "/Internal", true},
+	} {
+		hits.Store(0)
+		h := blockPathMiddleware(proxy, splitList("/internal,/admin"), tt.ignoreCase)
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.URL.Path = tt.path
+		resp, body := serve(h, req)
+		if blocked := resp.StatusCode == http.StatusNotFound && hits.Load() == 0; blocked != tt.blocked || (!tt.blocked && body != "upstream") {
+			t.Errorf("ignore case = %v, %s: status = %d, upstream hits = %d, want blocked = %v", tt.ignoreCase, tt.path, resp.StatusCode, hits.Load(), tt.blocked)
+		}
+	}
+}
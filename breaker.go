@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Minimal number of requests within a window before failure ratio is taken into account
+const breakerMinRequests = 5
+
+type breakerState int
+
+const (
+	stateClosed breakerState = iota
+	stateOpen
+	stateHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case stateOpen:
+		return "open"
+	case stateHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// breaker is a per upstream circuit breaker.
+// Closed breaker passes all requests and counts failures within a window,
+// open breaker rejects all requests until cooldown is elapsed,
+// half-open breaker passes a single probe request which decides whether to close or to open again.
+type breaker struct {
+	failureRatio float64
+	window       time.Duration
+	cooldown     time.Duration
+
+	mu          sync.Mutex
+	state       breakerState
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	probing     bool
+}
+
+// available reports whether allow would pass a request without reserving a half-open probe
+func (b *breaker) available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case stateOpen:
+		return time.Since(b.openedAt) >= b.cooldown
+	case stateHalfOpen:
+		return !b.probing
+	default:
+		return true
+	}
+}
+
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case stateOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = stateHalfOpen
+		b.probing = true
+		return true
+	case stateHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+func (b *breaker) record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	switch b.state {
+	case stateHalfOpen:
+		b.probing = false
+		if success {
+			b.state = stateClosed
+			b.windowStart, b.requests, b.failures = now, 0, 0
+		} else {
+			b.state = stateOpen
+			b.openedAt = now
+		}
+	case stateClosed:
+		if now.Sub(b.windowStart) > b.window {
+			b.windowStart, b.requests, b.failures = now, 0, 0
+		}
+		b.requests++
+		if !success {
+			b.failures++
+		}
+		if b.requests >= breakerMinRequests && float64(b.failures)/float64(b.requests) >= b.failureRatio {
+			b.state = stateOpen
+			b.openedAt = now
+		}
+	}
+}
+
+func (b *breaker) currentState() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func newBreakers(urls []*url.URL, failureRatio float64, window, cooldown time.Duration) map[*url.URL]*breaker {
+	breakers := make(map[*url.URL]*breaker)
+	for _, u := range urls {
+		breakers[u] = &breaker{
+			failureRatio: failureRatio,
+			window:       window,
+			cooldown:     cooldown,
+			windowStart:  time.Now(),
+		}
+	}
+	return breakers
+}
+
+type upstreamStatus struct {
+	URL   string `json:"url"`
+	State string `json:"state"`
+}
+
+// statusMiddleware serves circuit breaker states of upstreams on path
+func statusMiddleware(next http.Handler, path string, urls []*url.URL, breakers map[*url.URL]*breaker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var statuses []upstreamStatus
+		for _, u := range urls {
+			state := stateClosed
+			if b, ok := breakers[u]; ok {
+				state = b.currentState()
+			}
+			statuses = append(statuses, upstreamStatus{URL: u.Redacted(), State: state.String()})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(statuses); err != nil {
+			l.Println(err)
+		}
+	})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBreakerTransitions(t *testing.T) {
+	b := &breaker{failureRatio: 0.5, window: time.Minute, cooldown: 20 * time.Millisecond, windowStart: time.Now()}
+
+	for i := 0; i < breakerMinRequests; i++ {
+		if !b.allow() {
+			t.Fatalf("closed breaker rejected request %d", i)
+		}
+		b.record(false)
+	}
+	if s := b.currentState(); s != stateOpen {
+		t.Fatalf("state after %d failures = %v, want open", breakerMinRequests, s)
+	}
+	if b.allow() {
+		t.Fatal("open breaker passed request before cooldown")
+	}
+
+	time.Sleep(b.cooldown)
+	if !b.allow() {
+		t.Fatal("breaker rejected probe after cooldown")
+	}
+	if s := b.currentState(); s != stateHalfOpen {
+		t.Fatalf("state after cooldown = %v, want half-open", s)
+	}
+	if b.allow() {
+		t.Fatal("half-open breaker passed second request while probing")
+	}
+	b.record(false)
+	if s := b.currentState(); s != stateOpen {
+		t.Fatalf("state after failed probe = %v, want open", s)
+	}
+
+	time.Sleep(b.cooldown)
+	if !b.allow() {
+		t.Fatal("breaker rejected probe after cooldown")
+	}
+	b.record(true)
+	if s := b.currentState(); s != stateClosed {
+		t.Fatalf("state after successful probe = %v, want closed", s)
+	}
+	if !b.allow() {
+		t.Fatal("closed breaker rejected request")
+	}
+}
+
+func TestBreakerIgnoresFailuresBelowRatio(t *testing.T) {
+	b := &breaker{failureRatio: 0.5, window: time.Minute, cooldown: time.Minute, windowStart: time.Now()}
+	for i := 0; i < 10; i++ {
+		b.record(i%3 != 0)
+	}
+	if s := b.currentState(); s != stateClosed {
+		t.Fatalf("state = %v, want closed", s)
+	}
+}
+
+func TestEveryUpstreamEjected(t *testing.T) {
+	first, second := namedBackend("first"), namedBackend("second")
+	defer first.Close()
+	defer second.Close()
+	urls := backendURLs(t, first, second)
+
+	for _, tt := range []struct {
+		code int
+		want int
+	}{
+		{http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+		{http.StatusTooManyRequests, http.StatusTooManyRequests},
+		{0, http.StatusOK},
+	} {
+		c := testConfig()
+		c.NoUpstreamCode = tt.code
+		c.Breakers = newBreakers(urls, 0.5, time.Minute, time.Minute)
+		for _, u := range urls {
+			for i := 0; i < breakerMinRequests; i++ {
+				c.Breakers[u].record(false)
+			}
+		}
+		if resp, _ := serve(newProxy(urls, c), httptest.NewRequest(http.MethodGet, "/", nil)); resp.StatusCode != tt.want {
+			t.Errorf("no upstream code = %d: status = %d, want %d", tt.code, resp.StatusCode, tt.want)
+		}
+	}
+}
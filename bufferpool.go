@@ -0,0 +1,35 @@
+package main
+
+import "sync"
+
+// bufferPool reuses fixed size buffers ReverseProxy copies response bodies with,
+// pointers buffers are pooled with are reused as well so that neither Get nor Put allocates
+type bufferPool struct {
+	size    int
+	buffers sync.Pool
+	holders sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	return &bufferPool{size: size}
+}
+
+func (p *bufferPool) Get() []byte {
+	h, ok := p.buffers.Get().(*[]byte)
+	if !ok {
+		return make([]byte, p.size)
+	}
+	b := *h
+	*h = nil
+	p.holders.Put(h)
+	return b
+}
+
+func (p *bufferPool) Put(b []byte) {
+	h, ok := p.holders.Get().(*[]byte)
+	if !ok {
+		h = new([]byte)
+	}
+	*h = b
+	p.buffers.Put(h)
+}
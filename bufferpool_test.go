@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestBufferPoolDoesNotAllocate(t *testing.T) {
+	p := newBufferPool(32 << 10)
+	if n := len(p.Get()); n != 32<<10 {
+		t.Fatalf("buffer size = %d, want %d", n, 32<<10)
+	}
+	if allocs := testing.AllocsPerRun(100, func() {
+		p.Put(p.Get())
+	}); allocs > 0 {
+		t.Errorf("Get and Put allocate %v times, want none", allocs)
+	}
+}
+
+func BenchmarkBufferPool(b *testing.B) {
+	p := newBufferPool(32 << 10)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			p.Put(p.Get())
+		}
+	})
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type cacheEntry struct {
+	key     string
+	status  int
+	header  http.Header
+	body    []byte
+	trailer http.Header
+	expires time.Time
+}
+
+// responseCache is a size bounded LRU cache of upstream responses
+type responseCache struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	maxBytes int64
+	status   string
+	size     int64
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+// newResponseCache builds cache passing HIT or MISS in status header of responses, empty header means no status is passed
+func newResponseCache(ttl time.Duration, maxBytes int64, status string) *responseCache {
+	return &responseCache{
+		ttl:      ttl,
+		maxBytes: maxBytes,
+		status:   status,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (c *responseCache) get(key string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if time.Now().After(e.expires) {
+		c.remove(el)
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return e, true
+}
+
+func (c *responseCache) add(e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[e.key]; ok {
+		c.remove(el)
+	}
+	c.items[e.key] = c.ll.PushFront(e)
+	c.size += int64(len(e.body))
+	for c.size > c.maxBytes {
+		c.remove(c.ll.Back())
+	}
+}
+
+func (c *responseCache) remove(el *list.Element) {
+	e := c.ll.Remove(el).(*cacheEntry)
+	delete(c.items, e.key)
+	c.size -= int64(len(e.body))
+}
+
+// store caches response if request was initiated by cacheMiddleware and response is cacheable,
+// body is copied while it streams to client and the entry is added once it is read in full
+func (c *responseCache) store(resp *http.Response) error {
+	key, ok := resp.Request.Context().Value(cacheKey).(string)
+	if !ok {
+		return nil
+	}
+	if len(c.status) > 0 {
+		resp.Header.Set(c.status, "MISS")
+	}
+	if resp.StatusCode != http.StatusOK || resp.ContentLength > c.maxBytes || !isCacheable(resp.Header) {
+		return nil
+	}
+
+	resp.Body = &cachingBody{
+		ReadCloser: resp.Body,
+		cache:      c,
+		resp:       resp,
+		entry:      &cacheEntry{key: key, status: resp.StatusCode, header: resp.Header.Clone()},
+	}
+	return nil
+}
+
+// isCacheable reports whether response may be shared among clients, personal responses setting cookies
+// or marked as private and event streams are not
+func isCacheable(h http.Header) bool {
+	cc := strings.ToLower(h.Get("Cache-Control"))
+	if strings.Contains(cc, "no-store") || strings.Contains(cc, "private") {
+		return false
+	}
+	return len(h.Values("Set-Cookie")) == 0 && !isEventStream(h.Get("Content-Type"))
+}
+
+// cachingBody copies upstream response body as it is read, response is cached once body is read
+// up to EOF, bodies larger than cache maxBytes and truncated ones are not cached
+type cachingBody struct {
+	io.ReadCloser
+	cache *responseCache
+	resp  *http.Response
+	entry *cacheEntry
+	buf   bytes.Buffer
+	done  bool
+}
+
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.done {
+		return n, err
+	}
+	if int64(b.buf.Len()+n) > b.cache.maxBytes {
+		b.done = true
+		b.buf = bytes.Buffer{}
+		return n, err
+	}
+	b.buf.Write(p[:n])
+	if err == io.EOF {
+		b.done = true
+		b.entry.body = b.buf.Bytes()
+		b.entry.trailer = b.resp.Trailer.Clone()
+		b.entry.expires = time.Now().Add(b.cache.ttl)
+		b.cache.add(b.entry)
+	}
+	return n, err
+}
+
+func (c *responseCache) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Responses to requests with credentials or cookies may be personal
+		if r.Method != http.MethodGet || len(r.Header.Get("Authorization")) > 0 || len(r.Header.Get("Cookie")) > 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Responses are cached encoded as upstream sent them, so they're keyed by accepted encodings too,
+		// as well as by upstreams request is pinned to and values of upstream path placeholders
+		key := r.Method + " " + r.Host + r.URL.RequestURI() + " " + r.Header.Get("Accept-Encoding")
+		if pinned := pinnedTo(r.Context()); len(pinned) > 0 {
+			key += " " + pinned
+		}
+		if values, ok := r.Context().Value(templateKey).(map[string]string); ok {
+			key += " " + fmt.Sprint(values)
+		}
+		e, ok := c.get(key)
+		if !ok {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), cacheKey, key)))
+			return
+		}
+
+		for k, v := range e.header {
+			w.Header()[k] = v
+		}
+		if len(c.status) > 0 {
+			w.Header().Set(c.status, "HIT")
+		}
+		for k := range e.trailer {
+			w.Header().Add("Trailer", k)
+		}
+		w.WriteHeader(e.status)
+		if _, err := w.Write(e.body); err != nil {
+			l.Println(err)
+		}
+		for k, v := range e.trailer {
+			w.Header()[k] = v
+		}
+	})
+}
+
+// readCloser combines partially consumed body reader with original body closer
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newCachingProxy(t *testing.T, backend *httptest.Server) http.Handler {
+	c := testConfig()
+	c.Cache = newResponseCache(time.Minute, 1<<20, "X-Cache")
+	return c.Cache.middleware(newProxy(backendURLs(t, backend), c))
+}
+
+func TestCacheServesRepeatedGetFromCache(t *testing.T) {
+	var hits atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Write([]byte("cached"))
+	}))
+	defer backend.Close()
+	proxy := newCachingProxy(t, backend)
+
+	for i, want := range []string{"MISS", "HIT", "HIT"} {
+		resp, body := serve(proxy, httptest.NewRequest(http.MethodGet, "/a", nil))
+		if body != "cached" || resp.Header.Get("X-Cache") != want {
+			t.Errorf("request %d: body = %q, X-Cache = %q, want %q", i, body, resp.Header.Get("X-Cache"), want)
+		}
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("backend got %d requests, want 1", n)
+	}
+}
+
+func TestCacheKeyedByPinnedUpstream(t *testing.T) {
+	first, second, routed := namedBackend("first"), namedBackend("second"), namedBackend("routed")
+	defer first.Close()
+	defer second.Close()
+	defer routed.Close()
+	urls := backendURLs(t, first, second)
+	c := testConfig()
+	c.Cache = newResponseCache(time.Minute, 1<<20, "X-Cache")
+	proxy := c.Cache.middleware(newProxy(urls, c))
+	proxy = routeMiddleware(proxy, c, []*route{mustParseRoute(t, "header=X-Route,url="+routed.URL)})
+	proxy = upstreamOverrideMiddleware(proxy, urls)
+
+	for _, tt := range []struct {
+		header, value, want string
+	}{
+		{upstreamIndexHeader, "1", "second"},
+		{"X-Route", "1", "routed"},
+		{upstreamIndexHeader, "0", "first"},
+	} {
+		for _, status := range []string{"MISS", "HIT"} {
+			req := httptest.NewRequest(http.MethodGet, "/a", nil)
+			req.Header.Set(tt.header, tt.value)
+			if resp, body := serve(proxy, req); body != tt.want || resp.Header.Get("X-Cache") != status {
+				t.Errorf("%s: %s: body = %q, X-Cache = %q, want %q, %s", tt.header, tt.value, body, resp.Header.Get("X-Cache"), tt.want, status)
+			}
+		}
+	}
+}
+
+func TestCacheSkipsPersonalRequestsAndResponses(t *testing.T) {
+	var hits atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		switch r.URL.Path {
+		case "/cookie":
+			w.Header().Set("Set-Cookie", "session=1")
+		case "/private":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		case "/no-store":
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		w.Write([]byte("personal"))
+	}))
+	defer backend.Close()
+	proxy := newCachingProxy(t, backend)
+
+	for _, tt := range []struct {
+		path, header, value string
+	}{
+		{"/auth", "Authorization", "Basic dTpw"},
+		{"/request-cookie", "Cookie", "session=1"},
+		{"/cookie", "", ""},
+		{"/private", "", ""},
+		{"/no-store", "", ""},
+	} {
+		hits.Store(0)
+		for i := 0; i < 2; i++ {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if len(tt.header) > 0 {
+				req.Header.Set(tt.header, tt.value)
+			}
+			serve(proxy, req)
+		}
+		if n := hits.Load(); n != 2 {
+			t.Errorf("%s: backend got %d requests, want 2", tt.path, n)
+		}
+	}
+}
+
+func TestCacheDoesNotDelayStreamingResponse(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: 1\n\n"))
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer backend.Close()
+	defer close(release)
+	proxy := httptest.NewServer(newCachingProxy(t, backend))
+	defer proxy.Close()
+
+	resp, err := http.Get(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	line := make(chan string, 1)
+	go func() {
+		s, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		line <- s
+	}()
+	select {
+	case s := <-line:
+		if s != "data: 1\n" {
+			t.Errorf("first event line = %q", s)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("first event isn't passed until upstream response is finished")
+	}
+}
+
+func TestCacheStatusHeader(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/no-store" {
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		w.Write([]byte("body"))
+	}))
+	defer backend.Close()
+
+	for _, tt := range []struct {
+		header, path string
+		want         []string
+	}{
+		{"X-Proxy-Cache", "/a", []string{"MISS", "HIT"}},
+		{"X-Proxy-Cache", "/no-store", []string{"MISS", "MISS"}},
+		{"", "/a", []string{"", ""}},
+	} {
+		c := testConfig()
+		c.Cache = newResponseCache(time.Minute, 1<<20, tt.header)
+		proxy := c.Cache.middleware(newProxy(backendURLs(t, backend), c))
+		for i, want := range tt.want {
+			resp, _ := serve(proxy, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if got := resp.Header.Get("X-Proxy-Cache"); got != want {
+				t.Errorf("header %q, %s, request %d: X-Proxy-Cache = %q, want %q", tt.header, tt.path, i, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+)
+
+// canaryMiddleware pins requests of percent of clients to canary upstream u,
+// clients are split by hash of their address so every client consistently hits either canary or main pool
+func canaryMiddleware(next http.Handler, u *url.URL, percent int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(pinnedTo(r.Context())) > 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h := fnv.New32a()
+		h.Write([]byte(clientIP(r)))
+		if int(h.Sum32()%100) >= percent {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), overrideKey, u)))
+	})
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCanaryFractionAndStickiness(t *testing.T) {
+	stable, canary := namedBackend("stable"), namedBackend("canary")
+	defer stable.Close()
+	defer canary.Close()
+	proxy := canaryMiddleware(newProxy(backendURLs(t, stable), testConfig()), backendURLs(t, canary)[0], 20)
+
+	var canaries int
+	for i := 0; i < 1000; i++ {
+		addr := fmt.Sprintf("10.0.%d.%d:5000", i/250, i%250)
+		var first string
+		for j := 0; j < 3; j++ {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = addr
+			_, body := serve(proxy, req)
+			if j == 0 {
+				first = body
+			} else if body != first {
+				t.Fatalf("client %s is served by %q, then by %q", addr, first, body)
+			}
+		}
+		if first == "canary" {
+			canaries++
+		}
+	}
+	if canaries < 150 || canaries > 250 {
+		t.Errorf("%d of 1000 clients hit canary, want about 200", canaries)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+func parseCIDRs(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if len(f) == 0 {
+			continue
+		}
+		if !strings.Contains(f, "/") {
+			if strings.Contains(f, ":") {
+				f += "/128"
+			} else {
+				f += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(f)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// isTrusted reports whether request peer address belongs to one of trusted networks
+func isTrusted(remoteAddr string, trusted []*net.IPNet) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+var forwardedHeaders = []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "X-Real-IP", "Forwarded"}
+
+// forwardedHeadersMiddleware sanitizes incoming headers before they are logged and forwarded.
+// Client address headers sent by peers outside of trusted networks are dropped, so client address is taken from RemoteAddr.
+// With clobber every forwarding header is dropped unless the peer is trusted, so without trusted networks it is dropped
+// for every peer and only without clobber headers of any peer are kept. Headers listed in strip are always dropped.
+func forwardedHeadersMiddleware(next http.Handler, trusted []*net.IPNet, clobber bool, strip []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		trustedPeer := isTrusted(r.RemoteAddr, trusted)
+		if len(trusted) > 0 && !trustedPeer {
+			for _, h := range clientIPHeaders {
+				r.Header.Del(h)
+			}
+		}
+		if clobber && !trustedPeer {
+			for _, h := range forwardedHeaders {
+				r.Header.Del(h)
+			}
+			for _, h := range clientIPHeaders {
+				r.Header.Del(h)
+			}
+		}
+		for _, h := range strip {
+			r.Header.Del(h)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); len(f) > 0 {
+			list = append(list, f)
+		}
+	}
+	return list
+}
+
+// clientIP returns the first address of the first of clientIPHeaders sanitized by forwardedHeadersMiddleware or peer address
+func clientIP(r *http.Request) string {
+	for _, h := range clientIPHeaders {
+		if v := r.Header.Get(h); len(v) > 0 {
+			first, _, _ := strings.Cut(v, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// clientIPOf returns client address the handler chain behind forwardedHeadersMiddleware sees
+func clientIPOf(h func(http.Handler) http.Handler, remoteAddr string, header http.Header) string {
+	var ip string
+	handler := h(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip = clientIP(r)
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = remoteAddr
+	req.Header = header
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	return ip
+}
+
+func TestClientIPFromTrustedPeersOnly(t *testing.T) {
+	setGlobal(t, &clientIPHeaders, []string{"X-Forwarded-For"})
+	trusted, err := parseCIDRs("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	middleware := func(next http.Handler) http.Handler {
+		return forwardedHeadersMiddleware(next, trusted, false, nil)
+	}
+
+	for _, tt := range []struct {
+		peer, want string
+	}{
+		{"10.1.2.3:5000", "203.0.113.7"},
+		{"192.168.1.1:5000", "203.0.113.7"},
+		{"192.168.1.2:5000", "192.168.1.2"},
+		{"198.51.100.1:5000", "198.51.100.1"},
+	} {
+		header := http.Header{"X-Forwarded-For": {"203.0.113.7, 10.1.2.3"}}
+		if ip := clientIPOf(middleware, tt.peer, header); ip != tt.want {
+			t.Errorf("peer %s: client address = %s, want %s", tt.peer, ip, tt.want)
+		}
+	}
+}
+
+func TestClobberForwarded(t *testing.T) {
+	setGlobal(t, &clientIPHeaders, []string{"X-Forwarded-For"})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Forwarded-For") + "|" + r.Header.Get("X-Real-IP")))
+	}))
+	defer backend.Close()
+	proxy := newProxy(backendURLs(t, backend), testConfig())
+	trusted, _ := parseCIDRs("10.0.0.0/8")
+
+	for _, tt := range []struct {
+		name    string
+		trusted []*net.IPNet
+		clobber bool
+		peer    string
+		want    string
+	}{
+		{"no trusted networks", nil, true, "192.0.2.1:5000", "192.0.2.1|"},
+		{"untrusted peer", trusted, true, "192.0.2.1:5000", "192.0.2.1|"},
+		{"trusted peer", trusted, true, "10.0.0.1:5000", "203.0.113.7, 10.0.0.1|203.0.113.7"},
+		{"clobbering disabled", nil, false, "192.0.2.1:5000", "203.0.113.7, 192.0.2.1|203.0.113.7"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tt.peer
+		req.Header.Set("X-Forwarded-For", "203.0.113.7")
+		req.Header.Set("X-Real-IP", "203.0.113.7")
+		_, body := serve(forwardedHeadersMiddleware(proxy, tt.trusted, tt.clobber, nil), req)
+		if body != tt.want {
+			t.Errorf("%s: upstream got X-Forwarded-For|X-Real-IP %q, want %q", tt.name, body, tt.want)
+		}
+	}
+}
+
+func TestForwardingHeadersPassedFromTrustedPeers(t *testing.T) {
+	setGlobal(t, &clientIPHeaders, []string{"X-Forwarded-For"})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Forwarded-Host") + "|" + r.Header.Get("X-Forwarded-Proto") + "|" + r.Header.Get("Forwarded")))
+	}))
+	defer backend.Close()
+	proxy := newProxy(backendURLs(t, backend), testConfig())
+	trusted, _ := parseCIDRs("10.0.0.0/8")
+
+	for _, tt := range []struct {
+		name    string
+		clobber bool
+		peer    string
+		want    string
+	}{
+		{"trusted peer", true, "10.0.0.1:5000", "public.example.com|https|for=203.0.113.7"},
+		{"untrusted peer", true, "192.0.2.1:5000", "||"},
+		{"clobbering disabled", false, "192.0.2.1:5000", "public.example.com|https|for=203.0.113.7"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tt.peer
+		req.Header.Set("X-Forwarded-Host", "public.example.com")
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("Forwarded", "for=203.0.113.7")
+		_, body := serve(forwardedHeadersMiddleware(proxy, trusted, tt.clobber, nil), req)
+		if body != tt.want {
+			t.Errorf("%s: upstream got %q, want %q", tt.name, body, tt.want)
+		}
+	}
+}
+
+func TestClientIPHeaderSources(t *testing.T) {
+	setGlobal(t, &clientIPHeaders, splitList("CF-Connecting-IP,X-Real-IP,X-Forwarded-For"))
+	identity := func(next http.Handler) http.Handler { return next }
+
+	for _, tt := range []struct {
+		header http.Header
+		want   string
+	}{
+		{http.Header{"Cf-Connecting-Ip": {"203.0.113.1"}}, "203.0.113.1"},
+		{http.Header{"X-Real-Ip": {"203.0.113.2"}}, "203.0.113.2"},
+		{http.Header{"X-Forwarded-For": {"203.0.113.3, 10.0.0.1"}}, "203.0.113.3"},
+		{http.Header{"X-Real-Ip": {"203.0.113.2"}, "Cf-Connecting-Ip": {"203.0.113.1"}}, "203.0.113.1"},
+		{http.Header{"X-Forwarded-For": {"203.0.113.3"}, "X-Real-Ip": {"203.0.113.2"}}, "203.0.113.2"},
+		{http.Header{}, "198.51.100.1"},
+	} {
+		if ip := clientIPOf(identity, "198.51.100.1:5000", tt.header); ip != tt.want {
+			t.Errorf("%v: client address = %s, want %s", tt.header, ip, tt.want)
+		}
+	}
+}
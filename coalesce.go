@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// coalesceMiddleware lets concurrent identical GET requests pinned to the same upstream, if any, share one upstream
+// request and its response buffered in memory. Only responses with Content-Length up to maxBytes which could be
+// cached are shared, personal responses setting cookies or marked as private or no-store, event streams and responses
+// of unknown or larger length are passed to the initiating request as is, while the rest of requests are released
+// to be sent upstream on their own. Requests with credentials or cookies aren't coalesced
+// since their responses may be personal, range and upgrade requests aren't either.
+// If the initiating request goes away, its upstream request is canceled and the rest of requests are sent on their own.
+func coalesceMiddleware(next http.Handler, maxBytes int64) http.Handler {
+	var mu sync.Mutex
+	calls := make(map[string]*coalescedCall)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || len(r.Header.Get("Authorization")) > 0 || len(r.Header.Get("Cookie")) > 0 ||
+			len(r.Header.Get("Range")) > 0 || isUpgrade(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := coalesceKey(r)
+		mu.Lock()
+		if call, ok := calls[key]; ok {
+			mu.Unlock()
+			select {
+			case <-call.done:
+			case <-r.Context().Done():
+				return
+			}
+			if call.shared {
+				call.replay(w)
+			} else {
+				next.ServeHTTP(w, r)
+			}
+			return
+		}
+		call := &coalescedCall{done: make(chan struct{}), header: make(http.Header), status: http.StatusOK}
+		calls[key] = call
+		mu.Unlock()
+
+		release := func(shared bool) {
+			call.once.Do(func() {
+				mu.Lock()
+				delete(calls, key)
+				mu.Unlock()
+				call.shared = shared
+				close(call.done)
+			})
+		}
+		// upstream request may panic with http.ErrAbortHandler, the rest of requests mustn't wait forever then
+		defer release(false)
+
+		cw := &coalescingWriter{ResponseWriter: w, call: call, release: release, maxBytes: maxBytes}
+		next.ServeHTTP(cw, r)
+		if cw.passthrough {
+			return
+		}
+		release(r.Context().Err() == nil)
+		call.replay(w)
+	})
+}
+
+// coalesceKey identifies requests getting the same response, negotiated content is keyed by accepted variants
+func coalesceKey(r *http.Request) string {
+	key := r.Host + r.URL.RequestURI() + " " + r.Header.Get("Accept") + " " + r.Header.Get("Accept-Encoding") +
+		" " + r.Header.Get("Accept-Language")
+	if pinned := pinnedTo(r.Context()); len(pinned) > 0 {
+		key += " " + pinned
+	}
+	if values, ok := r.Context().Value(templateKey).(map[string]string); ok {
+		key += " " + fmt.Sprint(values)
+	}
+	return key
+}
+
+// coalescedCall is upstream request shared by coalesced requests, done is closed once its response
+// is buffered in full or turns out not to be shared
+type coalescedCall struct {
+	done   chan struct{}
+	once   sync.Once
+	shared bool
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+// replay writes buffered response of the call
+func (c *coalescedCall) replay(w http.ResponseWriter) {
+	for k, v := range c.header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(c.status)
+	if _, err := w.Write(c.body.Bytes()); err != nil {
+		l.Println(err)
+	}
+}
+
+// coalescingWriter buffers response of shared upstream request once its final headers show it may be shared,
+// otherwise response is passed to the initiating request as is, informational responses are dropped
+type coalescingWriter struct {
+	http.ResponseWriter
+	call        *coalescedCall
+	release     func(shared bool)
+	maxBytes    int64
+	wroteHeader bool
+	passthrough bool
+}
+
+func (w *coalescingWriter) Header() http.Header {
+	if w.passthrough {
+		return w.ResponseWriter.Header()
+	}
+	return w.call.header
+}
+
+func (w *coalescingWriter) WriteHeader(code int) {
+	if w.wroteHeader || code < http.StatusOK {
+		return
+	}
+	w.wroteHeader = true
+	w.call.status = code
+
+	length, err := strconv.ParseInt(w.call.header.Get("Content-Length"), 10, 64)
+	if err == nil && length <= w.maxBytes && isCacheable(w.call.header) {
+		return
+	}
+	w.passthrough = true
+	for k, v := range w.call.header {
+		w.ResponseWriter.Header()[k] = v
+	}
+	w.release(false)
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *coalescingWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.passthrough {
+		return w.ResponseWriter.Write(p)
+	}
+	return w.call.body.Write(p)
+}
+
+func (w *coalescingWriter) Flush() {
+	if !w.passthrough {
+		return
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *coalescingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fireConcurrently sends n identical requests with header set through proxy once all of them are in flight
+// and returns their bodies and number of requests the backend got
+func fireConcurrently(t *testing.T, n int, body func(w http.ResponseWriter), header ...string) ([]string, int32) {
+	t.Helper()
+	var hits, arrivals atomic.Int32
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		<-release
+		body(w)
+	}))
+	defer backend.Close()
+	coalescing := coalesceMiddleware(newProxy(backendURLs(t, backend), testConfig()), 1<<10)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrivals.Add(1)
+		coalescing.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	bodies := make([]string, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req, _ := http.NewRequest(http.MethodGet, proxy.URL+"/popular", nil)
+			for j := 0; j+1 < len(header); j += 2 {
+				req.Header.Set(header[j], header[j+1])
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			b, _ := io.ReadAll(resp.Body)
+			bodies[i] = string(b)
+		}(i)
+	}
+	for deadline := time.Now().Add(time.Second); arrivals.Load() < int32(n) && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	return bodies, hits.Load()
+}
+
+func TestCoalesceSharesOneUpstreamRequest(t *testing.T) {
+	bodies, hits := fireConcurrently(t, 10, func(w http.ResponseWriter) {
+		w.Write([]byte("popular"))
+	})
+	if hits != 1 {
+		t.Errorf("backend got %d requests, want 1", hits)
+	}
+	for i, body := range bodies {
+		if body != "popular" {
+			t.Errorf("request %d: body = %q, want shared response", i, body)
+		}
+	}
+}
+
+func TestCoalesceSkipsUnsharedResponses(t *testing.T) {
+	large := strings.Repeat("x", 2<<10)
+	for _, tt := range []struct {
+		name   string
+		body   func(w http.ResponseWriter)
+		header []string
+		want   string
+	}{
+		{"range", func(w http.ResponseWriter) { w.Write([]byte("part")) }, []string{"Range", "bytes=0-3"}, "part"},
+		{"over limit", func(w http.ResponseWriter) { w.Write([]byte(large)) }, nil, large},
+		{"cookie", func(w http.ResponseWriter) {
+			w.Header().Set("Set-Cookie", "session=personal")
+			w.Write([]byte("personal"))
+		}, nil, "personal"},
+		{"private", func(w http.ResponseWriter) {
+			w.Header().Set("Cache-Control", "private")
+			w.Write([]byte("personal"))
+		}, nil, "personal"},
+		{"no-store", func(w http.ResponseWriter) {
+			w.Header().Set("Cache-Control", "no-store")
+			w.Write([]byte("fresh"))
+		}, nil, "fresh"},
+		{"unknown length", func(w http.ResponseWriter) {
+			w.Write([]byte("chunk"))
+			w.(http.Flusher).Flush()
+		}, nil, "chunk"},
+	} {
+		bodies, hits := fireConcurrently(t, 3, tt.body, tt.header...)
+		if hits != 3 {
+			t.Errorf("%s: backend got %d requests, want 3", tt.name, hits)
+		}
+		for i, body := range bodies {
+			if body != tt.want {
+				t.Errorf("%s: request %d: body = %q, want %q", tt.name, i, body, tt.want)
+			}
+		}
+	}
+}
+
+func TestCoalesceKeysNegotiatedContent(t *testing.T) {
+	var hits atomic.Int32
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		<-release
+		w.Write([]byte(r.Header.Get("Accept") + r.Header.Get("Accept-Language")))
+	}))
+	defer backend.Close()
+	proxy := coalesceMiddleware(newProxy(backendURLs(t, backend), testConfig()), 1<<10)
+
+	headers := [][]string{{"Accept", "application/json"}, {"Accept", "text/html"}, {"Accept-Language", "de"}}
+	bodies := make([]string, len(headers))
+	var wg sync.WaitGroup
+	for i, h := range headers {
+		wg.Add(1)
+		go func(i int, h []string) {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodGet, "/negotiated", nil)
+			req.Header.Set(h[0], h[1])
+			_, bodies[i] = serve(proxy, req)
+		}(i, h)
+	}
+	for deadline := time.Now().Add(time.Second); hits.Load() < int32(len(headers)) && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	for i, h := range headers {
+		if bodies[i] != h[1] {
+			t.Errorf("%s: %s: body = %q, want response negotiated for it", h[0], h[1], bodies[i])
+		}
+	}
+}
+
+func TestCoalesceDoesNotHoldEventStreams(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: 1\n\n"))
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer backend.Close()
+	defer close(release)
+	proxy := httptest.NewServer(coalesceMiddleware(newProxy(backendURLs(t, backend), testConfig()), 1<<10))
+	defer proxy.Close()
+
+	lines := make(chan string, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			resp, err := http.Get(proxy.URL + "/events")
+			if err != nil {
+				lines <- err.Error()
+				return
+			}
+			defer resp.Body.Close()
+			s, _ := bufio.NewReader(resp.Body).ReadString('\n')
+			lines <- s
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case s := <-lines:
+			if s != "data: 1\n" {
+				t.Errorf("first event line = %q", s)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("event stream is held until upstream response is finished")
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// rewriteCookies replaces Domain attribute of Set-Cookie headers matching CookieDomainRewrites
+// and Path attribute prefix matching CookiePathRewrites, other attributes are kept as is
+func (c *ProxyConfig) rewriteCookies(resp *http.Response) {
+	cookies := resp.Header.Values("Set-Cookie")
+	for i, cookie := range cookies {
+		attrs := strings.Split(cookie, ";")
+		for j := 1; j < len(attrs); j++ {
+			name, value, _ := strings.Cut(strings.TrimSpace(attrs[j]), "=")
+			switch strings.ToLower(name) {
+			case "domain":
+				attrs[j] = " " + name + "=" + rewriteDomain(value, c.CookieDomainRewrites)
+			case "path":
+				attrs[j] = " " + name + "=" + rewritePath(value, c.CookiePathRewrites)
+			}
+		}
+		cookies[i] = strings.Join(attrs, ";")
+	}
+}
+
+func rewriteDomain(domain string, rewrites []rewritePair) string {
+	dot := strings.HasPrefix(domain, ".")
+	for _, r := range rewrites {
+		if strings.EqualFold(strings.TrimPrefix(domain, "."), r.from) {
+			if dot {
+				return "." + r.to
+			}
+			return r.to
+		}
+	}
+	return domain
+}
+
+func rewritePath(path string, rewrites []rewritePair) string {
+	for _, r := range rewrites {
+		if strings.HasPrefix(path, r.from) {
+			return r.to + path[len(r.from):]
+		}
+	}
+	return path
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCookieRewrite(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Set-Cookie", "session=1; Domain=internal.local; Path=/app/admin; HttpOnly")
+		w.Header().Add("Set-Cookie", "theme=dark; Domain=.internal.local; Path=/other")
+	}))
+	defer backend.Close()
+	c := testConfig()
+	c.CookieDomainRewrites = []rewritePair{{"internal.local", "public.example.com"}}
+	c.CookiePathRewrites = []rewritePair{{"/app/", "/"}}
+
+	resp, _ := serve(newProxy(backendURLs(t, backend), c), httptest.NewRequest(http.MethodGet, "/", nil))
+	cookies := resp.Header.Values("Set-Cookie")
+	want := []string{
+		"session=1; Domain=public.example.com; Path=/admin; HttpOnly",
+		"theme=dark; Domain=.public.example.com; Path=/other",
+	}
+	if len(cookies) != len(want) {
+		t.Fatalf("Set-Cookie = %q, want %q", cookies, want)
+	}
+	for i := range want {
+		if cookies[i] != want[i] {
+			t.Errorf("Set-Cookie = %q, want %q", cookies[i], want[i])
+		}
+	}
+}
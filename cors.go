@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// corsConfig holds CORS headers to answer preflight requests with
+type corsConfig struct {
+	origins []string
+	methods string
+	headers string
+	maxAge  int
+}
+
+func (c *corsConfig) allowOrigin(origin string) (string, bool) {
+	for _, o := range c.origins {
+		if o == "*" {
+			return "*", true
+		}
+		if strings.EqualFold(o, origin) {
+			return origin, true
+		}
+	}
+	return "", false
+}
+
+// preflightMiddleware answers CORS preflight requests itself instead of forwarding them to upstreams,
+// other OPTIONS requests are forwarded as usual
+func preflightMiddleware(next http.Handler, c *corsConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if r.Method != http.MethodOptions || len(origin) == 0 || len(r.Header.Get("Access-Control-Request-Method")) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		if allowed, ok := c.allowOrigin(origin); ok {
+			h.Set("Access-Control-Allow-Origin", allowed)
+			h.Set("Access-Control-Allow-Methods", c.methods)
+			if len(c.headers) > 0 {
+				h.Set("Access-Control-Allow-Headers", c.headers)
+			} else if requested := r.Header.Get("Access-Control-Request-Headers"); len(requested) > 0 {
+				h.Set("Access-Control-Allow-Headers", requested)
+			}
+			if c.maxAge > 0 {
+				h.Set("Access-Control-Max-Age", strconv.Itoa(c.maxAge))
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
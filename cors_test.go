@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPreflightAnsweredByProxy(t *testing.T) {
+	var hits atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Write([]byte(r.Method))
+	}))
+	defer backend.Close()
+	proxy := preflightMiddleware(newProxy(backendURLs(t, backend), testConfig()), &corsConfig{
+		origins: []string{"https://app.example.com"},
+		methods: "GET, POST",
+		maxAge:  600,
+	})
+
+	req := httptest.NewRequest(http.MethodOptions, "/api", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	req.Header.Set("Access-Control-Request-Headers", "Content-Type")
+	resp, _ := serve(proxy, req)
+	if resp.StatusCode != http.StatusNoContent || hits.Load() != 0 {
+		t.Fatalf("preflight: status = %d, upstream hits = %d, want 204 from proxy", resp.StatusCode, hits.Load())
+	}
+	for h, want := range map[string]string{
+		"Access-Control-Allow-Origin":  "https://app.example.com",
+		"Access-Control-Allow-Methods": "GET, POST",
+		"Access-Control-Allow-Headers": "Content-Type",
+		"Access-Control-Max-Age":       "600",
+	} {
+		if got := resp.Header.Get(h); got != want {
+			t.Errorf("%s = %q, want %q", h, got, want)
+		}
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodOptions} {
+		if _, body := serve(proxy, httptest.NewRequest(method, "/api", nil)); body != method {
+			t.Errorf("%s is answered with %q, want it forwarded", method, body)
+		}
+	}
+}
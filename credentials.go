@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var secretRef = regexp.MustCompile(`\$\{(\w+)\}`)
+
+// expandSecrets replaces ${NAME} references with value of NAME environment variable or content of file
+// named by NAME_FILE variable, so credentials embedded in upstream URL don't show up in process listing.
+// Values are escaped according to the part of URL the reference is in.
+func expandSecrets(s string) (string, error) {
+	var b strings.Builder
+	last := 0
+	for _, m := range secretRef.FindAllStringSubmatchIndex(s, -1) {
+		v, err := lookupSecret(s[m[2]:m[3]])
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(s[last:m[0]])
+		b.WriteString(secretEscaper(s, m[0])(v))
+		last = m[1]
+	}
+	b.WriteString(s[last:])
+	return b.String(), nil
+}
+
+// secretEscaper returns escaping of value substituted at offset i of URL s: userinfo, path, query and fragment values
+// are escaped so they can't spill over to other parts, scheme, host and port are left as is
+func secretEscaper(s string, i int) func(string) string {
+	asIs := func(v string) string { return v }
+	start := 0
+	if j := strings.Index(s, "://"); j >= 0 {
+		start = j + len("://")
+	}
+	if i < start {
+		return asIs
+	}
+	end := len(s)
+	if j := strings.IndexAny(s[start:], "/?#"); j >= 0 {
+		end = start + j
+	}
+	if i < end {
+		if at := strings.LastIndex(s[start:end], "@"); at >= 0 && i < start+at {
+			return func(v string) string { return url.User(v).String() }
+		}
+		return asIs
+	}
+	if j := strings.Index(s, "#"); j >= 0 && i > j {
+		return func(v string) string { return (&url.URL{Fragment: v}).EscapedFragment() }
+	}
+	if j := strings.Index(s, "?"); j >= 0 && i > j {
+		return url.QueryEscape
+	}
+	return func(v string) string { return (&url.URL{Path: v}).EscapedPath() }
+}
+
+func lookupSecret(name string) (string, error) {
+	if v, ok := os.LookupEnv(name); ok {
+		return v, nil
+	}
+	if file, ok := os.LookupEnv(name + "_FILE"); ok {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+	return "", fmt.Errorf("neither %s nor %s_FILE environment variable is set", name, name)
+}
+
+// loadCredentials reads upstream basic auth credentials from file with lines in form of host[:port] user:password,
+// host is matched against host of upstream URL, empty lines and lines starting with # are skipped
+func loadCredentials(file string) (map[string]*url.Userinfo, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	credentials := make(map[string]*url.Userinfo)
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		host, userinfo, ok := strings.Cut(line, " ")
+		user, password, hasPassword := strings.Cut(strings.TrimSpace(userinfo), ":")
+		if !ok || !hasPassword || len(user) == 0 {
+			return nil, fmt.Errorf("%s:%d must be in form of host user:password", file, n)
+		}
+		credentials[host] = url.UserPassword(user, password)
+	}
+	return credentials, s.Err()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// authBackend responds with its name to requests with user and password and with 401 to others
+func authBackend(name, user, password string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != user || p != password {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(name))
+	}))
+}
+
+func TestPooledUpstreamsWithOwnCredentials(t *testing.T) {
+	alpha, beta := authBackend("alpha", "svc", "alpha-secret"), authBackend("beta", "svc", "beta-secret")
+	defer alpha.Close()
+	defer beta.Close()
+	secret := filepath.Join(t.TempDir(), "beta")
+	if err := os.WriteFile(secret, []byte("beta-secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ALPHA_PASSWORD", "alpha-secret")
+	t.Setenv("BETA_PASSWORD_FILE", secret)
+
+	urls, err := (&arrayFlags{
+		strings.Replace(alpha.URL, "://", "://svc:${ALPHA_PASSWORD}@", 1),
+		strings.Replace(beta.URL, "://", "://svc:${BETA_PASSWORD}@", 1),
+	}).toURLs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := newProxy(urls, testConfig())
+	served := make(map[string]int)
+	for i := 0; i < 20; i++ {
+		resp, body := serve(proxy, httptest.NewRequest(http.MethodGet, "/", nil))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, want upstream credentials to be accepted", resp.StatusCode)
+		}
+		served[body]++
+	}
+	if served["alpha"] == 0 || served["beta"] == 0 {
+		t.Errorf("requests are served by %v, want both upstreams", served)
+	}
+}
+
+func TestSecretsEscapedByURLPart(t *testing.T) {
+	t.Setenv("PASSWORD", "p@ss:w/rd")
+	t.Setenv("HOST", "api.internal:8443")
+	t.Setenv("TENANT", "acme corp")
+	t.Setenv("TOKEN", "a&b=c+d")
+
+	urls, err := (&arrayFlags{"http://svc:${PASSWORD}@${HOST}/${TENANT}/v1?token=${TOKEN}"}).toURLs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := urls[0]
+	if password, _ := u.User.Password(); password != "p@ss:w/rd" {
+		t.Errorf("password = %q", password)
+	}
+	if u.Host != "api.internal:8443" || u.Path != "/acme corp/v1" || u.Query().Get("token") != "a&b=c+d" {
+		t.Errorf("host = %q, path = %q, query = %q, want secrets kept within their parts", u.Host, u.Path, u.RawQuery)
+	}
+}
+
+func TestCredentialsFile(t *testing.T) {
+	alpha, beta := authBackend("alpha", "svc", "alpha-secret"), authBackend("beta", "admin", "beta:secret")
+	defer alpha.Close()
+	defer beta.Close()
+	urls := backendURLs(t, alpha, beta)
+	file := filepath.Join(t.TempDir(), "credentials")
+	content := "# upstream credentials\n\n" + urls[0].Host + " svc:alpha-secret\n" + urls[1].Host + " admin:beta:secret\n"
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := testConfig()
+	c.Balancer = failoverBalancer{}
+	credentials, err := loadCredentials(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Credentials = credentials
+	for _, u := range urls {
+		resp, body := serve(newProxy([]*url.URL{u}, c), httptest.NewRequest(http.MethodGet, "/", nil))
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: status = %d, body = %q, want mapped credentials to be accepted", u.Host, resp.StatusCode, body)
+		}
+	}
+
+	if err := os.WriteFile(file, []byte(urls[0].Host+" svc\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadCredentials(file); err == nil || !strings.Contains(err.Error(), file+":1") {
+		t.Errorf("error = %v, want invalid line to be reported", err)
+	}
+}
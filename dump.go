@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+)
+
+// redactHeader returns a copy of header with values of headers listed in DumpRedact replaced
+func (c *ProxyConfig) redactHeader(header http.Header) http.Header {
+	redacted := header.Clone()
+	for _, h := range strings.Split(c.DumpRedact, ",") {
+		h = strings.TrimSpace(h)
+		if len(h) > 0 && redacted.Get(h) != "" {
+			redacted.Set(h, "***")
+		}
+	}
+	return redacted
+}
+
+func dumpMiddleware(next http.Handler, c *ProxyConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		redacted := *r
+		redacted.Header = c.redactHeader(r.Header)
+		dump, err := httputil.DumpRequest(&redacted, false)
+		if err != nil {
+			log.Printf("Failed to dump request: %v", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, rc, err := c.dumpBody(r.Body, r.ContentLength, r.Header)
+		r.Body = rc
+		if err != nil {
+			log.Printf("Failed to dump request: %v", err)
+		} else {
+			log.Println(string(dump) + string(body))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (c *ProxyConfig) dumpUpstreamResponse(resp *http.Response) {
+	redacted := *resp
+	redacted.Header = c.redactHeader(resp.Header)
+	dump, err := httputil.DumpResponse(&redacted, false)
+	if err != nil {
+		log.Printf("Failed to dump response: %v", err)
+		return
+	}
+	body, rc, err := c.dumpBody(resp.Body, resp.ContentLength, resp.Header)
+	resp.Body = rc
+	if err != nil {
+		log.Printf("Failed to dump response: %v", err)
+		return
+	}
+	log.Println(string(dump) + string(body))
+}
+
+// dumpBody reads up to DumpMaxBytes of rc and returns them along with a reader which still yields the full body.
+// Event streams and bodies of unknown length are not read since they may be streamed for as long as connection lasts.
+func (c *ProxyConfig) dumpBody(rc io.ReadCloser, length int64, header http.Header) ([]byte, io.ReadCloser, error) {
+	if rc == nil || rc == http.NoBody {
+		return nil, rc, nil
+	}
+	if length < 0 || isEventStream(header.Get("Content-Type")) {
+		return []byte("[streamed body is not dumped]"), rc, nil
+	}
+
+	r := io.Reader(rc)
+	if c.DumpMaxBytes > 0 {
+		r = io.LimitReader(rc, c.DumpMaxBytes+1)
+	}
+	body, err := io.ReadAll(r)
+	rest := readCloser{io.MultiReader(bytes.NewReader(body), rc), rc}
+	if err != nil {
+		return nil, rest, err
+	}
+
+	if c.DumpMaxBytes > 0 && int64(len(body)) > c.DumpMaxBytes {
+		return append(body[:c.DumpMaxBytes:c.DumpMaxBytes], "...[truncated]"...), rest, nil
+	}
+	return body, rest, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureLog redirects standard logger dumps are written with to a buffer until the test ends
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buf
+}
+
+func TestDumpResponse(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Backend", "one")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created body"))
+	}))
+	defer backend.Close()
+	out := captureLog(t)
+
+	c := testConfig()
+	c.DumpResponse = true
+	_, body := serve(newProxy(backendURLs(t, backend), c), httptest.NewRequest(http.MethodGet, "/", nil))
+	if body != "created body" {
+		t.Errorf("client got body %q, want upstream body", body)
+	}
+	for _, want := range []string{"201 Created", "X-Backend: one", "created body"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("dump %q doesn't contain %q", out, want)
+		}
+	}
+}
+
+func TestDumpRedactsHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Authorization")))
+	}))
+	defer backend.Close()
+	out := captureLog(t)
+	c := testConfig()
+	c.DumpRedact = "Authorization,Cookie"
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	_, body := serve(dumpMiddleware(newProxy(backendURLs(t, backend), c), c), req)
+	if body != "Bearer secret" {
+		t.Errorf("upstream got Authorization %q, want it intact", body)
+	}
+	if strings.Contains(out.String(), "secret") || !strings.Contains(out.String(), "Authorization: ***") {
+		t.Errorf("dump %q isn't redacted", out)
+	}
+}
+
+func TestDumpTruncatesBody(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer backend.Close()
+	out := captureLog(t)
+	c := testConfig()
+	c.DumpMaxBytes = 10
+
+	payload := strings.Repeat("0123456789", 100)
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(payload))
+	_, body := serve(dumpMiddleware(newProxy(backendURLs(t, backend), c), c), req)
+	if body != payload {
+		t.Errorf("upstream got %d body bytes, want %d", len(body), len(payload))
+	}
+	if !strings.Contains(out.String(), "0123456789...[truncated]") || strings.Contains(out.String(), "01234567890") {
+		t.Errorf("dump %q isn't truncated to 10 bytes", out)
+	}
+}
+
+func TestDumpSkipsStreamedBodies(t *testing.T) {
+	for _, contentType := range []string{"text/event-stream", "application/x-ndjson"} {
+		release := make(chan struct{})
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			w.Write([]byte("data: 1\n"))
+			w.(http.Flusher).Flush()
+			<-release
+		}))
+		out := captureLog(t)
+		c := testConfig()
+		c.DumpResponse = true
+		proxy := httptest.NewServer(newProxy(backendURLs(t, backend), c))
+
+		// Response headers are held as well while the body is dumped, so the whole request runs aside
+		line := make(chan string, 1)
+		go func() {
+			resp, err := http.Get(proxy.URL)
+			if err != nil {
+				line <- err.Error()
+				return
+			}
+			defer resp.Body.Close()
+			s, _ := bufio.NewReader(resp.Body).ReadString('\n')
+			line <- s
+		}()
+		select {
+		case s := <-line:
+			if s != "data: 1\n" || !strings.Contains(out.String(), "[streamed body is not dumped]") {
+				t.Errorf("%s: first line = %q, dump = %q, want streamed body passed without dumping", contentType, s, out)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s: first line is held by dump", contentType)
+		}
+		close(release)
+		proxy.Close()
+		backend.Close()
+	}
+}
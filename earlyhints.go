@@ -0,0 +1,32 @@
+package main
+
+import "net/http"
+
+// dropEarlyHintsMiddleware drops 103 Early Hints which ReverseProxy relays from upstreams,
+// ReverseProxy clears relayed hint headers itself so they don't leak into the final response
+func dropEarlyHintsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(noEarlyHintsWriter{w}, r)
+	})
+}
+
+type noEarlyHintsWriter struct {
+	http.ResponseWriter
+}
+
+func (w noEarlyHintsWriter) WriteHeader(code int) {
+	if code == http.StatusEarlyHints {
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w noEarlyHintsWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w noEarlyHintsWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"testing"
+)
+
+func TestEarlyHintsRelay(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Del("Link")
+		w.Write([]byte("page"))
+	}))
+	defer backend.Close()
+	proxy := newProxy(backendURLs(t, backend), testConfig())
+
+	for _, tt := range []struct {
+		enabled bool
+		handler http.Handler
+	}{
+		{true, proxy},
+		{false, dropEarlyHintsMiddleware(proxy)},
+	} {
+		server := httptest.NewServer(tt.handler)
+		var hints []string
+		ctx := httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{
+			Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+				if code == http.StatusEarlyHints {
+					hints = append(hints, header.Get("Link"))
+				}
+				return nil
+			},
+		})
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		server.Close()
+		if got := len(hints) == 1 && hints[0] == "</style.css>; rel=preload; as=style"; got != tt.enabled {
+			t.Errorf("early hints = %v: client got hints %q", tt.enabled, hints)
+		}
+		if resp.StatusCode != http.StatusOK || len(resp.Header.Get("Link")) > 0 {
+			t.Errorf("early hints = %v: final status = %d, Link = %q, want 200 without hint headers", tt.enabled, resp.StatusCode, resp.Header.Get("Link"))
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const envPrefix = "HTTPROXY_"
+
+// envName returns name of environment variable for flag, i.e. HTTPROXY_MAX_HEADER_BYTES for -max-header-bytes
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// setFlagsFromEnv sets flags not passed on command line from environment variables,
+// values of repeatable flags are comma separated, commas inside a value like in routes are escaped as \,
+func setFlagsFromEnv() error {
+	passed := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		passed[f.Name] = true
+	})
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if err != nil || passed[f.Name] {
+			return
+		}
+		v, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+		values := []string{v}
+		if _, ok := f.Value.(*arrayFlags); ok {
+			values = splitEscaped(v, ',')
+		}
+		for _, value := range values {
+			if value = strings.TrimSpace(value); len(value) == 0 && len(values) > 1 {
+				continue
+			}
+			if e := f.Value.Set(value); e != nil {
+				err = fmt.Errorf("%s: %v", envName(f.Name), e)
+				return
+			}
+		}
+	})
+	return err
+}
+
+// splitEscaped splits s by sep unless it is preceded by backslash, the backslash is removed then
+func splitEscaped(s string, sep byte) []string {
+	var values []string
+	var value strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && s[i+1] == sep:
+			value.WriteByte(sep)
+			i++
+		case s[i] == sep:
+			values = append(values, value.String())
+			value.Reset()
+		default:
+			value.WriteByte(s[i])
+		}
+	}
+	return append(values, value.String())
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"reflect"
+	"testing"
+)
+
+func TestSetFlagsFromEnv(t *testing.T) {
+	setGlobal(t, &flag.CommandLine, flag.NewFlagSet("httproxy", flag.ContinueOnError))
+	var urls, routes, bodies arrayFlags
+	var port string
+	var retries int
+	flag.Var(&urls, "url", "")
+	flag.Var(&routes, "route", "")
+	flag.Var(&bodies, "override-body", "")
+	flag.StringVar(&port, "port", "8080", "")
+	flag.IntVar(&retries, "retries", 1, "")
+	if err := flag.CommandLine.Parse([]string{"-retries", "3"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HTTPROXY_URL", "http://a:8080, http://b:8080,")
+	t.Setenv("HTTPROXY_ROUTE", `header=X-Beta\,url=http://beta:8080,host=*.api.example.com\,url=http://api:8080`)
+	t.Setenv("HTTPROXY_OVERRIDE_BODY", `404={"error":"x"\,"code":1}`)
+	t.Setenv("HTTPROXY_PORT", "9000")
+	t.Setenv("HTTPROXY_RETRIES", "5")
+
+	if err := setFlagsFromEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if want := (arrayFlags{"http://a:8080", "http://b:8080"}); !reflect.DeepEqual(urls, want) {
+		t.Errorf("urls = %q, want %q", urls, want)
+	}
+	if want := (arrayFlags{"header=X-Beta,url=http://beta:8080", "host=*.api.example.com,url=http://api:8080"}); !reflect.DeepEqual(routes, want) {
+		t.Errorf("routes = %q, want %q", routes, want)
+	}
+	if want := (arrayFlags{`404={"error":"x","code":1}`}); !reflect.DeepEqual(bodies, want) {
+		t.Errorf("override bodies = %q, want %q", bodies, want)
+	}
+	if port != "9000" {
+		t.Errorf("port = %q, want 9000 from environment", port)
+	}
+	if retries != 3 {
+		t.Errorf("retries = %d, want 3 passed on command line", retries)
+	}
+
+	t.Setenv("HTTPROXY_RETRIES", "many")
+	setGlobal(t, &flag.CommandLine, flag.NewFlagSet("httproxy", flag.ContinueOnError))
+	flag.IntVar(&retries, "retries", 1, "")
+	if err := setFlagsFromEnv(); err == nil {
+		t.Error("invalid value of environment variable is accepted")
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/unrolled/logger"
+)
+
+func TestErrorType(t *testing.T) {
+	dead := deadBackend()
+	resetting := resettingBackend()
+	defer resetting.Close()
+	untrusted := httptest.NewTLSServer(http.NotFoundHandler())
+	defer untrusted.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	roundTrip := func(url string, timeout time.Duration) error {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		resp, err := transport.RoundTrip(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, _ := http.NewRequestWithContext(canceled, http.MethodGet, slow.URL, nil)
+	_, canceledErr := transport.RoundTrip(req)
+
+	for _, tt := range []struct {
+		err  error
+		want string
+	}{
+		{fmt.Errorf("proxy: %w", errNoUpstream), "no_upstream"},
+		{roundTrip("http://upstream.invalid", time.Second), "dns"},
+		{roundTrip(dead.URL, time.Second), "connect_refused"},
+		{roundTrip(resetting.URL, time.Second), "reset"},
+		{roundTrip(untrusted.URL, time.Second), "tls"},
+		{roundTrip(slow.URL, 20*time.Millisecond), "timeout"},
+		{canceledErr, "canceled"},
+	} {
+		if got := errorType(tt.err); got != tt.want {
+			t.Errorf("%v: error type = %s, want %s", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestErrorTypeLogged(t *testing.T) {
+	var out bytes.Buffer
+	c := testConfig()
+	c.Logger = logger.New(logger.Options{Out: &out})
+	backend := deadBackend()
+	serve(newProxy(backendURLs(t, backend), c), httptest.NewRequest(http.MethodGet, "/", nil))
+	if want := "Proxy error: upstream = " + backend.URL + ", error_type = connect_refused, "; !strings.Contains(out.String(), want) {
+		t.Errorf("log %q doesn't contain %q", out.String(), want)
+	}
+}
@@ -1,5 +1,11 @@
 module github.com/dddpaul/httproxy
 
-go 1.19
+go 1.20
 
-require github.com/unrolled/logger v0.0.0-20190327162521-be1a2406c7c9
+require (
+	github.com/unrolled/logger v0.0.0-20190327162521-be1a2406c7c9
+	golang.org/x/net v0.17.0
+	gopkg.in/natefinch/lumberjack.v2 v2.2.1
+)
+
+require golang.org/x/text v0.13.0 // indirect
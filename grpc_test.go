@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// grpcFrame prefixes message with gRPC length-prefixed message header
+func grpcFrame(msg string) []byte {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+// grpcEchoBackend echoes gRPC messages back after delay, message "missing" fails with NOT_FOUND status
+func grpcEchoBackend(delay time.Duration) *httptest.Server {
+	return httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.Header.Get("Content-Type") != "application/grpc" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		time.Sleep(delay)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		if bytes.Equal(body, grpcFrame("missing")) {
+			w.Header().Set("Grpc-Status", "5")
+			w.Header().Set("Grpc-Message", "not found")
+			return
+		}
+		w.Write(body)
+		w.Header().Set("Grpc-Status", "0")
+	}), &http2.Server{}))
+}
+
+func TestGRPCTrailersAndStatus(t *testing.T) {
+	backend := grpcEchoBackend(100 * time.Millisecond)
+	defer backend.Close()
+	setGlobal(t, &upstreamHTTP2, true)
+	transport, err := newTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := testConfig()
+	c.Transport = transport
+	c.GRPC = true
+	c.Timeout = 50 * time.Millisecond
+	proxy := httptest.NewServer(h2c.NewHandler(newProxy(backendURLs(t, backend), c), &http2.Server{}))
+	defer proxy.Close()
+
+	for _, tt := range []struct {
+		msg, status, message, body string
+	}{
+		{"ping", "0", "", string(grpcFrame("ping"))},
+		{"missing", "5", "not found", ""},
+	} {
+		req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/echo.Echo/Say", bytes.NewReader(grpcFrame(tt.msg)))
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("TE", "trailers")
+		resp, err := h2cClient().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != tt.body {
+			t.Errorf("%s: status = %d, body = %q, want 200 with %q despite proxy timeout", tt.msg, resp.StatusCode, body, tt.body)
+		}
+		if s, m := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message"); s != tt.status || m != tt.message {
+			t.Errorf("%s: trailers Grpc-Status = %q, Grpc-Message = %q, want %q, %q", tt.msg, s, m, tt.status, tt.message)
+		}
+	}
+}
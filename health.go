@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Interval between upstream reachability probes at startup
+const waitProbeInterval = 500 * time.Millisecond
+
+// healthMiddleware serves liveness and readiness probes of the proxy itself on liveness and readiness paths,
+// empty path means the probe is not served. Proxy is ready while at least one upstream is available.
+func healthMiddleware(next http.Handler, c *ProxyConfig, urls []*url.URL, liveness, readiness string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case len(liveness) > 0 && r.URL.Path == liveness:
+			w.WriteHeader(http.StatusOK)
+		case len(readiness) > 0 && r.URL.Path == readiness:
+			if !shuttingDown.Load() && len(c.available(urls)) > 0 {
+				w.WriteHeader(http.StatusOK)
+			} else {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// waitForUpstreams blocks until at least one upstream accepts TCP connection or timeout is elapsed
+func waitForUpstreams(urls []*url.URL, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for attempt := 1; ; attempt++ {
+		for _, u := range urls {
+			if isReachable(u) {
+				l.Printf("Upstream %s is reachable\n", u.Redacted())
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			l.Printf("No upstream is reachable within %v, starting anyway\n", timeout)
+			return
+		}
+		l.Printf("Waiting for upstreams, attempt %d: none is reachable\n", attempt)
+		time.Sleep(waitProbeInterval)
+	}
+}
+
+func isReachable(u *url.URL) bool {
+	port := u.Port()
+	if len(port) == 0 {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(u.Hostname(), port), waitProbeInterval)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
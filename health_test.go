@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestReadiness(t *testing.T) {
+	a, _ := url.Parse("http://a:8080")
+	b, _ := url.Parse("http://b:8080")
+	urls := []*url.URL{a, b}
+	c := testConfig()
+	c.Breakers = newBreakers(urls, 0.5, time.Minute, 20*time.Millisecond)
+	c.Drains = newDrainSet()
+	h := healthMiddleware(http.NotFoundHandler(), c, urls, "/healthz", "/readyz")
+	probe := func(path string) int {
+		resp, _ := serve(h, httptest.NewRequest(http.MethodGet, path, nil))
+		return resp.StatusCode
+	}
+
+	if code := probe("/readyz"); code != http.StatusOK {
+		t.Errorf("readiness with healthy upstreams = %d, want 200", code)
+	}
+	for _, u := range urls {
+		for i := 0; i < breakerMinRequests; i++ {
+			c.Breakers[u].record(false)
+		}
+	}
+	if code := probe("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("readiness with every upstream ejected = %d, want 503", code)
+	}
+	if code := probe("/healthz"); code != http.StatusOK {
+		t.Errorf("liveness with every upstream ejected = %d, want 200", code)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	c.Breakers[a].allow()
+	c.Breakers[a].record(true)
+	c.Breakers[b].allow()
+	if code := probe("/readyz"); code != http.StatusOK {
+		t.Errorf("readiness with recovered upstream = %d, want 200", code)
+	}
+	c.Drains.set(a, true)
+	if code := probe("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("readiness with recovered upstream drained = %d, want 503", code)
+	}
+	if code := probe("/other"); code != http.StatusNotFound {
+		t.Errorf("other path = %d, want it passed through", code)
+	}
+}
+
+func TestWaitForUpstreams(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	u, _ := url.Parse("http://" + addr)
+
+	start := time.Now()
+	waitForUpstreams([]*url.URL{u}, 0)
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("waited %v for unreachable upstream with zero timeout", d)
+	}
+
+	up := make(chan net.Listener, 1)
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Error(err)
+		}
+		up <- ln
+	}()
+	start = time.Now()
+	waitForUpstreams([]*url.URL{u}, 5*time.Second)
+	ln = <-up
+	if ln != nil {
+		defer ln.Close()
+	}
+	if d := time.Since(start); d < 300*time.Millisecond || d > 3*time.Second {
+		t.Errorf("waited %v for upstream coming up after 300ms", d)
+	}
+}
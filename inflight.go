@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var errUpstreamsBusy = errors.New("every upstream has reached in-flight requests limit")
+
+// inFlight limits number of concurrent requests per upstream
+type inFlight struct {
+	max      int
+	mu       sync.Mutex
+	counts   map[*url.URL]int
+	released chan struct{}
+}
+
+func newInFlight(max int) *inFlight {
+	return &inFlight{
+		max:      max,
+		counts:   make(map[*url.URL]int),
+		released: make(chan struct{}),
+	}
+}
+
+func (f *inFlight) release(u *url.URL) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.counts[u]--
+	close(f.released)
+	f.released = make(chan struct{})
+}
+
+// releasedChan returns channel closed on the next release
+func (f *inFlight) releasedChan() <-chan struct{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.released
+}
+
+// acquire picks upstream among targets which has not reached the limit yet. Slots are counted under the same lock
+// the upstream is picked with, so a half-open breaker probe is never reserved for an upstream without a free slot.
+func (f *inFlight) acquire(c *ProxyConfig, targets []*url.URL) (*url.URL, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var candidates []*url.URL
+	for _, t := range targets {
+		if f.counts[t] < f.max {
+			candidates = append(candidates, t)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, false
+	}
+	u := c.loadBalance(candidates)
+	if u == nil {
+		return nil, false
+	}
+	f.counts[u]++
+	return u, true
+}
+
+// inFlightMiddleware pins request to an upstream below in-flight requests limit,
+// if there is none it waits up to wait for a slot to be released and responds with 503 then
+func inFlightMiddleware(next http.Handler, c *ProxyConfig, urls []*url.URL, f *inFlight, wait time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		targets := upstreams(r.Context(), urls)
+		if u, ok := r.Context().Value(overrideKey).(*url.URL); ok {
+			targets = []*url.URL{u}
+		}
+
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		for {
+			released := f.releasedChan()
+			if u, ok := f.acquire(c, targets); ok {
+				defer f.release(u)
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), overrideKey, u)))
+				return
+			}
+			select {
+			case <-released:
+			case <-timer.C:
+				c.Logger.Println("Proxy error:", errUpstreamsBusy)
+				if len(c.OverloadBody) > 0 {
+					c.writeOverloadResponse(w)
+				} else {
+					c.writeErrorResponse(w, r, http.StatusServiceUnavailable, errUpstreamsBusy)
+				}
+				return
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// blockingBackend responds with name once release is closed and signals every received request to started
+func blockingBackend(name string, started chan<- struct{}, release <-chan struct{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.Write([]byte(name))
+	}))
+}
+
+func TestInFlightLimitPerUpstream(t *testing.T) {
+	started, release := make(chan struct{}, 10), make(chan struct{})
+	busy := blockingBackend("busy", started, release)
+	defer busy.Close()
+	defer close(release)
+	idle := namedBackend("idle")
+	defer idle.Close()
+
+	c := testConfig()
+	f := newInFlight(1)
+	urls := backendURLs(t, busy, idle)
+	only := urls[:1]
+	proxy := inFlightMiddleware(newProxy(urls, c), c, urls, f, 50*time.Millisecond)
+	shedding := inFlightMiddleware(newProxy(only, c), c, only, f, 50*time.Millisecond)
+	go serve(shedding, httptest.NewRequest(http.MethodGet, "/", nil))
+	<-started
+
+	for i := 0; i < 10; i++ {
+		if _, body := serve(proxy, httptest.NewRequest(http.MethodGet, "/", nil)); body != "idle" {
+			t.Fatalf("request over limit of busy upstream is served by %q, want idle one", body)
+		}
+	}
+	if resp, _ := serve(shedding, httptest.NewRequest(http.MethodGet, "/", nil)); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("request over limit of every upstream: status = %d, want 503", resp.StatusCode)
+	}
+}
+
+func TestInFlightKeepsProbeOfFullUpstream(t *testing.T) {
+	targets := arrayFlags{"http://half-open:8080", "http://closed:8080"}
+	urls, err := targets.toURLs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := testConfig()
+	c.Breakers = newBreakers(urls, 0.5, time.Minute, 0)
+	halfOpen := c.Breakers[urls[0]]
+	for i := 0; i < breakerMinRequests; i++ {
+		halfOpen.record(false)
+	}
+	f := newInFlight(1)
+	f.counts[urls[0]] = 1
+
+	for i := 0; i < 10; i++ {
+		u, ok := f.acquire(c, urls)
+		if !ok || u != urls[1] {
+			t.Fatalf("acquired %v, want upstream with free slot", u)
+		}
+		f.release(u)
+	}
+	if !halfOpen.available() {
+		t.Fatal("probe is reserved for upstream without free slot")
+	}
+	f.release(urls[0])
+	if u, ok := f.acquire(c, urls[:1]); !ok || u != urls[0] || halfOpen.currentState() != stateHalfOpen {
+		t.Errorf("acquired %v in state %v, want probe of freed upstream", u, halfOpen.currentState())
+	}
+}
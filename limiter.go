@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// concurrencyLimitMiddleware passes up to max concurrent requests, the rest wait in FIFO queue
+// up to queueTimeout and are rejected with 503 if no request is finished meanwhile
+func concurrencyLimitMiddleware(next http.Handler, c *ProxyConfig, max int, queueTimeout time.Duration) http.Handler {
+	sem := make(chan struct{}, max)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case sem <- struct{}{}:
+		default:
+			ctx, cancel := context.WithTimeout(r.Context(), queueTimeout)
+			defer cancel()
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				c.writeOverloadResponse(w)
+				return
+			}
+		}
+		defer func() { <-sem }()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeOverloadResponse responds with 503 to request shed under load, with OverloadBody if it is set
+func (c *ProxyConfig) writeOverloadResponse(w http.ResponseWriter) {
+	if len(c.OverloadBody) == 0 {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	if len(c.OverloadContentType) > 0 {
+		w.Header().Set("Content-Type", c.OverloadContentType)
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+	if _, err := w.Write([]byte(c.OverloadBody)); err != nil {
+		c.Logger.Println(err)
+	}
+}
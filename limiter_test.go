@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyLimitQueuesBurst(t *testing.T) {
+	started, release := make(chan struct{}, 10), make(chan struct{})
+	backend := blockingBackend("backend", started, release)
+	defer backend.Close()
+	c := testConfig()
+	proxy := concurrencyLimitMiddleware(newProxy(backendURLs(t, backend), c), c, 2, time.Second)
+
+	codes := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			resp, _ := serve(proxy, httptest.NewRequest(http.MethodGet, "/", nil))
+			codes <- resp.StatusCode
+		}()
+	}
+	<-started
+	<-started
+	select {
+	case <-started:
+		t.Fatal("request over limit isn't queued")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	for i := 0; i < 3; i++ {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("status = %d, want queued request to be served", code)
+		}
+	}
+}
+
+func TestConcurrencyLimitShedsAfterQueueTimeout(t *testing.T) {
+	started, release := make(chan struct{}, 10), make(chan struct{})
+	backend := blockingBackend("backend", started, release)
+	defer backend.Close()
+	defer close(release)
+	c := testConfig()
+	proxy := concurrencyLimitMiddleware(newProxy(backendURLs(t, backend), c), c, 1, 20*time.Millisecond)
+	go serve(proxy, httptest.NewRequest(http.MethodGet, "/", nil))
+	<-started
+
+	if resp, _ := serve(proxy, httptest.NewRequest(http.MethodGet, "/", nil)); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503 after queue timeout", resp.StatusCode)
+	}
+}
+
+func TestOverloadResponseBody(t *testing.T) {
+	started, release := make(chan struct{}, 10), make(chan struct{})
+	backend := blockingBackend("backend", started, release)
+	defer backend.Close()
+	defer close(release)
+	c := testConfig()
+	c.OverloadBody, c.OverloadContentType = `{"error":"overloaded"}`, "application/json"
+	urls := backendURLs(t, backend)
+
+	for name, proxy := range map[string]http.Handler{
+		"max-concurrent":   concurrencyLimitMiddleware(newProxy(urls, c), c, 1, 0),
+		"max-per-upstream": inFlightMiddleware(newProxy(urls, c), c, urls, newInFlight(1), 0),
+	} {
+		go serve(proxy, httptest.NewRequest(http.MethodGet, "/", nil))
+		<-started
+		resp, body := serve(proxy, httptest.NewRequest(http.MethodGet, "/", nil))
+		if resp.StatusCode != http.StatusServiceUnavailable || body != c.OverloadBody || resp.Header.Get("Content-Type") != c.OverloadContentType {
+			t.Errorf("%s: status = %d, Content-Type = %q, body = %q, want 503 with configured body", name, resp.StatusCode, resp.Header.Get("Content-Type"), body)
+		}
+	}
+}
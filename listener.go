@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/net/netutil"
+)
+
+// listen listens on TCP address with keep-alive period of accepted connections and up to maxConnections
+// of them open at once, 0 means no limit
+func listen(addr string, keepAlive time.Duration, maxConnections int) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	ln = tcpKeepAliveListener{ln.(*net.TCPListener), keepAlive}
+	if maxConnections > 0 {
+		ln = netutil.LimitListener(ln, maxConnections)
+	}
+	return ln, nil
+}
+
+// tcpKeepAliveListener sets TCP keep-alive period of accepted connections, zero period disables keep-alive
+type tcpKeepAliveListener struct {
+	*net.TCPListener
+	period time.Duration
+}
+
+func (ln tcpKeepAliveListener) Accept() (net.Conn, error) {
+	conn, err := ln.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	// like net/http, errors are ignored since the connection is still usable without keep-alive
+	if ln.period > 0 {
+		conn.SetKeepAlive(true)
+		conn.SetKeepAlivePeriod(ln.period)
+	} else {
+		conn.SetKeepAlive(false)
+	}
+	return conn, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestKeepAliveListenerAccepts(t *testing.T) {
+	for _, period := range []time.Duration{0, time.Minute} {
+		tl, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln := tcpKeepAliveListener{tl, period}
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatalf("period %v: accept failed: %v", period, err)
+		}
+		if _, ok := conn.(*net.TCPConn); !ok {
+			t.Errorf("period %v: accepted %T, want *net.TCPConn", period, conn)
+		}
+		conn.Close()
+		client.Close()
+		ln.Close()
+	}
+}
+
+func TestListenLimitsConnections(t *testing.T) {
+	ln, err := listen("127.0.0.1:0", 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 3)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+	}
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		select {
+		case conn := <-accepted:
+			conns = append(conns, conn)
+		case <-time.After(time.Second):
+			t.Fatalf("connection %d isn't accepted within limit", i)
+		}
+	}
+	select {
+	case conn := <-accepted:
+		conn.Close()
+		t.Fatal("connection over limit is accepted")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	conns[0].Close()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(time.Second):
+		t.Fatal("waiting connection isn't accepted once another is closed")
+	}
+	conns[1].Close()
+}
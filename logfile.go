@@ -0,0 +1,29 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// newLogFile returns size rotated log file writer which is also rotated on SIGHUP to interoperate with logrotate
+func newLogFile(filename string, maxSize, maxBackups int) *lumberjack.Logger {
+	w := &lumberjack.Logger{
+		Filename:   filename,
+		MaxSize:    maxSize,
+		MaxBackups: maxBackups,
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := w.Rotate(); err != nil {
+				log.Printf("Failed to reopen log file: %v", err)
+			}
+		}
+	}()
+	return w
+}
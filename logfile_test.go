@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func countFiles(t *testing.T, dir string) int {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+func TestLogFileRotation(t *testing.T) {
+	dir := t.TempDir()
+	w := newLogFile(filepath.Join(dir, "access.log"), 1, 3)
+	defer w.Close()
+
+	line := append(bytes.Repeat([]byte("x"), 1023), '\n')
+	for i := 0; i < 1025; i++ {
+		if _, err := w.Write(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := countFiles(t, dir); n != 2 {
+		t.Fatalf("%d files after exceeding max size, want current and rotated one", n)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(time.Second); countFiles(t, dir) != 3; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d files after SIGHUP, want current and two rotated ones", countFiles(t, dir))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -1,17 +1,21 @@
 package main
 
 import (
-	"context"
 	"flag"
+	"fmt"
+	"io"
 	"log"
-	"math/rand"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/unrolled/logger"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 type arrayFlags []string
@@ -25,159 +29,645 @@ func (flags *arrayFlags) Set(value string) error {
 	return nil
 }
 
-func (flags *arrayFlags) toURLs() []*url.URL {
+func (flags *arrayFlags) toURLs() ([]*url.URL, error) {
 	var urls []*url.URL
 	for _, s := range *flags {
-		u, err := url.Parse(s)
+		expanded, err := expandSecrets(s)
 		if err != nil {
-			panic(err)
+			return nil, fmt.Errorf("%s: %v", s, err)
+		}
+		u, err := url.Parse(expanded)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", s, err.(*url.Error).Err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("%s: unsupported scheme %q, http or https is expected", s, u.Scheme)
+		}
+		if len(u.Host) == 0 {
+			return nil, fmt.Errorf("%s: host is missing", s)
 		}
 		urls = append(urls, u)
 	}
-	return urls
+	return urls, nil
+}
+
+// millisDuration is a duration flag which accepts bare integers as milliseconds for backward compatibility
+type millisDuration time.Duration
+
+func (d millisDuration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *millisDuration) Set(value string) error {
+	if ms, err := strconv.ParseInt(value, 10, 64); err == nil {
+		*d = millisDuration(time.Duration(ms) * time.Millisecond)
+		return nil
+	}
+	v, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = millisDuration(v)
+	return nil
 }
 
+// Build info, injected with -ldflags "-X main.version=..."
+var (
+	version   = "dev"
+	commit    = "none"
+	buildDate = "unknown"
+)
+
+var showVersion bool
+var dryRun bool
 var prefix string
 var verbose bool
+var statsInterval time.Duration
+var slowThreshold time.Duration
+var logTimings bool
 var dump bool
+var dumpResponse bool
+var dumpMaxBytes int64
+var dumpRedact string
 var port string
+var tlsCert string
+var tlsKey string
+var clientCAFile string
+var requireClientCert bool
+var forwardClientCert bool
+var tcpKeepAlive time.Duration
+var maxHeaderBytes int
+var maxURIBytes int
+var maxConnections int
+var copyBufferSize int
+var shutdownTimeout time.Duration
+var writeTimeout time.Duration
+var idleTimeout time.Duration
+var streamWriteTimeout time.Duration
+var preShutdownDelay time.Duration
+var waitForUpstreamsFlag bool
+var waitTimeout time.Duration
 var urls arrayFlags
 var followRedirects bool
-var timeout int64
+var preserveHost bool
+var rawPath bool
+var synthesizeHead bool
+var earlyHints bool
+var xForwardedFor string
+var trailingSlash string
+var allowMethods string
+var blockPaths string
+var blockPathIgnoreCase bool
+var handlePreflight bool
+var corsAllowOrigins string
+var corsAllowMethods string
+var corsAllowHeaders string
+var corsMaxAge int
+var upstreamUserAgent string
+var credentialsFile string
+var viaName string
+var timeout millisDuration
+var propagateDeadline bool
 var errorResponseCode int
+var timeoutResponseCode int
+var connectErrorCode int
+var noUpstreamCode int
 var errorResponseBody string
+var errorResponseContentType string
+var overloadResponseBody string
+var overloadResponseContentType string
+var errorResponseFile string
+var fallbackDir string
+var cbFailureRatio float64
+var cbWindow time.Duration
+var cbCooldown time.Duration
+var lbStrategy string
+var lbSeed int64
+var weights string
+var allowUpstreamOverride bool
+var maxConcurrent int
+var queueTimeout time.Duration
+var maxPerUpstream int
+var maxPerUpstreamWait time.Duration
+var exposeUpstreamHeader string
+var hideBackendHeaders bool
+var bodyRewrites arrayFlags
+var bodyRewriteMaxBytes int64
+var maxModifyBodyBytes int64
+var statusRemaps arrayFlags
+var overrideBodies arrayFlags
+var cookieDomainRewrites arrayFlags
+var cookiePathRewrites arrayFlags
+var trustedProxies string
+var clientIPHeaderList string
+var clientIPHeaders []string
+var clobberForwarded bool
+var stripRequestHeaders string
+var statusPath string
+var livenessPath string
+var readinessPath string
+var cacheTTL time.Duration
+var cacheMaxBytes int64
+var cacheStatusHeader string
+var coalesce bool
+var coalesceMaxBody int64
+var retries int
+var retryOn string
+var retryTruncated bool
+var retryBackoff time.Duration
+var retryBackoffMax time.Duration
+var retryJitter float64
+var bufferRequestBody bool
+var maxBufferBytes int64
+var routes arrayFlags
+var upstreamProxy string
+var canaryURL string
+var canaryPercent int
+var mirrorURL string
+var mirrorRatio float64
+var mirrorMaxBody int64
+var mirrorTimeout time.Duration
+var socks5 string
+var maxIdleConns int
+var maxIdleConnsPerHost int
+var idleConnTimeout time.Duration
+var disableKeepAlives bool
+var dialTimeout time.Duration
+var responseHeaderTimeout time.Duration
+var expectContinueTimeout time.Duration
+var upstreamHTTP2 bool
+var upstreamCAFile string
+var h2cListener bool
+var grpcMode bool
+var adminPort string
+var pprofEnabled bool
+var maintenanceFile string
+var logFile string
+var logMaxSize int
+var logMaxBackups int
 var l *logger.Logger
 
+type contextKey int
+
+const (
+	upstreamKey contextKey = iota
+	pathKey
+	rawPathKey
+	cancelKey
+	overrideKey
+	cacheKey
+	startKey
+	routeKey
+	noteKey
+	templateKey
+	headKey
+	timingsKey
+)
+
 func main() {
+	flag.BoolVar(&showVersion, "version", false, "Print version and exit")
+	flag.BoolVar(&dryRun, "dry-run", false, "Validate configuration and exit without serving")
 	flag.StringVar(&prefix, "prefix", "httproxy", "Logging prefix")
 	flag.BoolVar(&verbose, "verbose", false, "Print request details")
+	flag.BoolVar(&logTimings, "log-timings", false, "Log time to connect to upstream, time to its first response byte and total time of every request")
+	flag.DurationVar(&slowThreshold, "slow-threshold", 0, "Log requests served longer than a given duration along with their upstream, i.e. 500ms, 0 means disabled")
+	flag.DurationVar(&statsInterval, "stats-interval", 0, "Log requests and bytes counters summary with a given interval, i.e. 1m, 0 means disabled")
 	flag.BoolVar(&dump, "dump", false, "Dump request body")
+	flag.BoolVar(&dumpResponse, "dump-response", false, "Dump upstream response")
+	flag.Int64Var(&dumpMaxBytes, "dump-max-bytes", 64<<10, "Maximum number of dumped body bytes, 0 means no limit")
+	flag.StringVar(&dumpRedact, "dump-redact", "Authorization,Cookie,Set-Cookie", "Comma separated list of headers to redact in dump output")
+	flag.StringVar(&logFile, "log-file", "", "File to write logs to instead of stdout, reopened on SIGHUP")
+	flag.IntVar(&logMaxSize, "log-max-size", 100, "Maximum size of log file before rotation (megabytes)")
+	flag.IntVar(&logMaxBackups, "log-max-backups", 3, "Maximum number of rotated log files to retain, 0 means retain all")
 	flag.StringVar(&port, "port", ":8080", "Port to listen (prepended by colon), i.e. :8080")
-	flag.Var(&urls, "url", "List of URL to proxy to, i.e. http://localhost:8081")
+	flag.StringVar(&tlsCert, "tls-cert", "", "PEM certificate file to serve HTTPS with, requires -tls-key")
+	flag.StringVar(&tlsKey, "tls-key", "", "PEM private key file of -tls-cert")
+	flag.StringVar(&clientCAFile, "client-ca-file", "", "PEM file with CA certificates to verify client certificates with")
+	flag.BoolVar(&requireClientCert, "require-client-cert", false, "Reject TLS clients without certificate verified by -client-ca-file")
+	flag.BoolVar(&forwardClientCert, "forward-client-cert", false, "Pass verified client certificate subject to upstream in X-Client-Cert-Subject and X-Client-Cert-Verified headers")
+	flag.DurationVar(&tcpKeepAlive, "tcp-keepalive", 15*time.Second, "TCP keep-alive period of client connections, 0 disables keep-alive")
+	flag.IntVar(&maxHeaderBytes, "max-header-bytes", http.DefaultMaxHeaderBytes, "Maximum size of request headers (bytes), larger ones are rejected with 431")
+	flag.IntVar(&maxURIBytes, "max-uri-bytes", 0, "Maximum size of request URI (bytes), longer ones are rejected with 414, 0 means no limit")
+	flag.IntVar(&maxConnections, "max-connections", 0, "Maximum number of open client connections, new ones wait in listen backlog until others are closed, 0 means no limit")
+	flag.IntVar(&copyBufferSize, "copy-buffer-size", 32<<10, "Size of pooled buffers to copy response bodies with (bytes), 0 means allocate a buffer per request")
+	flag.DurationVar(&writeTimeout, "write-timeout", 0, "Maximum time to write response to client, 0 means no timeout")
+	flag.DurationVar(&idleTimeout, "idle-timeout", 0, "Time to keep idle client connections open, 0 means no timeout")
+	flag.DurationVar(&streamWriteTimeout, "stream-write-timeout", 0, "Write timeout of text/event-stream responses overriding -write-timeout, 0 means no timeout")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "Time to wait for active requests on SIGTERM or SIGINT, second signal forces immediate exit")
+	flag.BoolVar(&waitForUpstreamsFlag, "wait-for-upstreams", false, "Delay serving until at least one upstream accepts connections or -wait-timeout is elapsed")
+	flag.DurationVar(&waitTimeout, "wait-timeout", 30*time.Second, "Maximum time to wait for upstreams with -wait-for-upstreams")
+	flag.DurationVar(&preShutdownDelay, "pre-shutdown-delay", 0, "Time to fail readiness probe on SIGTERM or SIGINT before shutting down, i.e. 5s")
+	flag.Var(&urls, "url", "List of URL to proxy to, i.e. http://localhost:8081, ${NAME} is replaced with NAME environment variable or content of file named by NAME_FILE, {host} and {header:Name} in path with incoming request values")
+	flag.Var(&routes, "route", "Route requests with matching host and header to other upstreams, i.e. name=v2,header=X-Api-Version:2,url=http://v2:8080 or host=*.api.example.com,url=http://api:8080, host is exact, wildcard or regular expression prefixed with ~, exact hosts take precedence, header without value matches its presence, name is logged and counted, timeout, retries and error-response-code override global ones for the route")
 	flag.BoolVar(&followRedirects, "follow", false, "Follow 3xx redirects internally")
-	flag.Int64Var(&timeout, "timeout", 0, "Proxy request timeout (ms), 0 means no timeout")
+	flag.BoolVar(&preserveHost, "preserve-host", false, "Pass incoming Host header to upstream instead of upstream host")
+	flag.BoolVar(&synthesizeHead, "synthesize-head", false, "Send GET to upstream instead of HEAD and drop response body, for upstreams not implementing HEAD")
+	flag.BoolVar(&earlyHints, "early-hints", false, "Relay 103 Early Hints responses of upstreams to clients")
+	flag.BoolVar(&rawPath, "raw-path", false, "Pass encoded request path to upstream exactly as sent by client, i.e. keep %2F")
+	flag.StringVar(&xForwardedFor, "x-forwarded-for", "append", "X-Forwarded-For handling: append client address or drop the header")
+	flag.StringVar(&viaName, "via-name", "httproxy", "Name to append to Via header of upstream requests and client responses, empty means no Via header")
+	flag.StringVar(&upstreamUserAgent, "upstream-user-agent", "", "User-Agent to send to upstream, client one is passed in X-Original-User-Agent, empty means pass client User-Agent")
+	flag.StringVar(&credentialsFile, "credentials-file", "", "File with upstream basic auth credentials in lines of host[:port] user:password, used for upstreams without credentials in URL")
+	flag.StringVar(&allowMethods, "allow-methods", "", "Comma separated list of allowed request methods, others are rejected with 405, i.e. GET,HEAD,OPTIONS, empty means any method")
+	flag.StringVar(&blockPaths, "block-path", "", "Comma separated list of path prefixes to respond with 404 to without proxying, i.e. /internal,/admin")
+	flag.BoolVar(&blockPathIgnoreCase, "block-path-ignore-case", false, "Match -block-path prefixes case-insensitively")
+	flag.BoolVar(&handlePreflight, "handle-preflight", false, "Answer CORS preflight requests with -cors-* headers instead of forwarding them")
+	flag.StringVar(&corsAllowOrigins, "cors-allow-origins", "*", "Comma separated list of origins allowed in preflight responses, * means any")
+	flag.StringVar(&corsAllowMethods, "cors-allow-methods", "GET,HEAD,POST,PUT,PATCH,DELETE", "Methods allowed in preflight responses")
+	flag.StringVar(&corsAllowHeaders, "cors-allow-headers", "", "Headers allowed in preflight responses, empty means requested ones")
+	flag.IntVar(&corsMaxAge, "cors-max-age", 0, "Seconds to cache preflight responses for, 0 means no Access-Control-Max-Age")
+	flag.StringVar(&trailingSlash, "trailing-slash", "none", "Redirect with 308 to path with trailing slash added (add), removed (remove) or don't redirect (none)")
+	flag.Var(&timeout, "timeout", "Proxy request timeout, i.e. 30s, bare number is milliseconds, 0 means no timeout, upgraded connections like WebSocket are not limited")
+	flag.BoolVar(&propagateDeadline, "propagate-deadline", false, "Pass milliseconds left of -timeout to upstream in X-Request-Deadline header")
 	flag.IntVar(&errorResponseCode, "error-response-code", http.StatusBadGateway, "Override HTTP response code on proxy error")
-	flag.StringVar(&errorResponseBody, "error-response-body", "", "Body content on proxy error")
+	flag.IntVar(&timeoutResponseCode, "timeout-response-code", http.StatusGatewayTimeout, "HTTP response code on upstream timeout")
+	flag.IntVar(&connectErrorCode, "connect-error-code", http.StatusBadGateway, "HTTP response code on upstream connection failure")
+	flag.IntVar(&noUpstreamCode, "no-upstream-code", http.StatusServiceUnavailable, "HTTP response code when every upstream is drained or has open circuit breaker, 0 means proxy to one of them anyway")
+	flag.StringVar(&errorResponseBody, "error-response-body", "", "Body content on proxy error, may be a template referencing {{.Error}}, {{.Upstream}} and {{.StatusCode}}")
+	flag.StringVar(&errorResponseContentType, "error-response-content-type", "", "Content-Type of body on proxy error")
+	flag.StringVar(&overloadResponseBody, "overload-response-body", "", "Body content of 503 responses to requests shed by -max-concurrent or -max-per-upstream")
+	flag.StringVar(&overloadResponseContentType, "overload-response-content-type", "", "Content-Type of -overload-response-body")
+	flag.StringVar(&errorResponseFile, "error-response-file", "", "File to read body content on proxy error from, overrides -error-response-body")
+	flag.StringVar(&fallbackDir, "fallback-dir", "", "Directory to serve file matching request path or index.html from on proxy error instead of error response")
+	flag.StringVar(&lbStrategy, "lb-strategy", "random", "Load balancing strategy: random, weighted, p2c (power of two choices by response time) or failover (first healthy upstream in listed order)")
+	flag.StringVar(&weights, "weights", "", "Comma separated upstream weights for weighted strategy in the same order as -url, i.e. 3,1")
+	flag.Int64Var(&lbSeed, "lb-seed", 0, "Seed of load balancing random choices to make them reproducible, 0 means seed with current time")
+	flag.BoolVar(&allowUpstreamOverride, "allow-upstream-override", false, "Allow to pin request to upstream by its zero-based index in X-Upstream-Index header")
+	flag.IntVar(&maxConcurrent, "max-concurrent", 0, "Maximum number of concurrently proxied requests, 0 means no limit")
+	flag.DurationVar(&queueTimeout, "queue-timeout", 0, "Time to wait in queue when -max-concurrent is reached before responding with 503, 0 means no waiting")
+	flag.IntVar(&maxPerUpstream, "max-per-upstream", 0, "Maximum number of in-flight requests per upstream, requests over the limit go to another upstream, 0 means no limit")
+	flag.DurationVar(&maxPerUpstreamWait, "max-per-upstream-wait", 100*time.Millisecond, "Time to wait for a free upstream when every one has reached -max-per-upstream before responding with 503")
+	flag.StringVar(&exposeUpstreamHeader, "expose-upstream-header", "", "Response header to pass chosen upstream host in, i.e. X-Upstream, empty means disabled")
+	flag.BoolVar(&hideBackendHeaders, "hide-backend-headers", false, "Drop Server, X-Powered-By, X-AspNet-Version and X-AspNetMvc-Version headers of upstream responses")
+	flag.Var(&bodyRewrites, "body-rewrite", "Replace text in textual response bodies, i.e. http://internal:8080=https://public.example.com")
+	flag.Int64Var(&bodyRewriteMaxBytes, "body-rewrite-max-bytes", 10<<20, "Maximum size of response body to rewrite (bytes), larger ones are passed unchanged")
+	flag.Int64Var(&maxModifyBodyBytes, "max-modify-body-bytes", 0, "Maximum size of response body to follow redirect of, rewrite or override (bytes), larger ones stream unchanged, 0 means no limit")
+	flag.Var(&statusRemaps, "remap-status", "Replace status of upstream responses, i.e. 401=403 or 5xx=502, body is kept unless -override-body is set for the new status")
+	flag.Var(&overrideBodies, "override-body", "Replace body of upstream responses with a given status, i.e. 404='{\"error\":\"not found\"}'")
+	flag.Var(&cookieDomainRewrites, "cookie-domain-rewrite", "Replace Domain attribute of upstream cookies, i.e. internal.local=public.example.com")
+	flag.Var(&cookiePathRewrites, "cookie-path-rewrite", "Replace Path attribute prefix of upstream cookies, i.e. /app/=/")
+	flag.StringVar(&trustedProxies, "trusted-proxies", "", "Comma separated list of CIDRs allowed to pass client address in -client-ip-headers, empty means no peer is trusted, so client address is taken from headers of any peer only with -clobber-forwarded=false")
+	flag.StringVar(&clientIPHeaderList, "client-ip-headers", "X-Forwarded-For", "Comma separated ordered list of headers to take client address from for logging, canary split and allowlists, i.e. CF-Connecting-IP,X-Real-IP,X-Forwarded-For, peer address is used if none is sent")
+	flag.BoolVar(&clobberForwarded, "clobber-forwarded", true, "Drop X-Forwarded-For, X-Forwarded-Host, X-Forwarded-Proto, X-Real-IP, Forwarded and -client-ip-headers sent by peers not listed in -trusted-proxies, i.e. by every peer if it is empty")
+	flag.StringVar(&stripRequestHeaders, "strip-request-headers", "", "Comma separated list of incoming request headers to drop before forwarding")
+	flag.Float64Var(&cbFailureRatio, "cb-failure-ratio", 0, "Failure ratio within window to open upstream circuit breaker, 0 means no circuit breaker")
+	flag.DurationVar(&cbWindow, "cb-window", 10*time.Second, "Circuit breaker failure counting window")
+	flag.DurationVar(&cbCooldown, "cb-cooldown", 30*time.Second, "Circuit breaker cooldown before probing upstream again")
+	flag.StringVar(&statusPath, "status-path", "", "Path to serve upstreams status on, i.e. /status, empty means disabled")
+	flag.DurationVar(&cacheTTL, "cache-ttl", 0, "Cache GET responses for a given duration, i.e. 30s, 0 means no caching, requests with Authorization or Cookie and responses with Set-Cookie or Cache-Control private are not cached")
+	flag.Int64Var(&cacheMaxBytes, "cache-max-bytes", 64<<20, "Maximum size of cached response bodies (bytes)")
+	flag.StringVar(&cacheStatusHeader, "cache-status-header", "", "Response header to pass HIT or MISS of -cache-ttl cache in, i.e. X-Cache, empty means disabled")
+	flag.BoolVar(&coalesce, "coalesce", false, "Share one upstream request and its response buffered in memory among concurrent identical GET requests without Authorization, Cookie and Range")
+	flag.Int64Var(&coalesceMaxBody, "coalesce-max-body", 1<<20, "Maximum Content-Length of shared -coalesce response (bytes), larger, unknown length and event stream responses aren't shared")
+	flag.IntVar(&retries, "retries", 1, "Maximum number of retries on statuses listed in -retry-on-status")
+	flag.StringVar(&retryOn, "retry-on-status", "", "Comma separated list of upstream statuses to retry idempotent requests on another upstream, i.e. 503,502")
+	flag.BoolVar(&retryTruncated, "retry-truncated", false, "Retry idempotent requests on another upstream if upstream closes connection before sending any body byte")
+	flag.DurationVar(&retryBackoff, "retry-backoff", 0, "Delay before the first retry doubled for every next one, i.e. 50ms, 0 means retry immediately")
+	flag.DurationVar(&retryBackoffMax, "retry-backoff-max", time.Second, "Maximum delay between retries")
+	flag.Float64Var(&retryJitter, "retry-jitter", 0.5, "Fraction of retry delay to randomly shorten it by, from 0 to 1")
+	flag.BoolVar(&bufferRequestBody, "buffer-request-body", false, "Buffer request body in memory so requests with body including POST can be retried")
+	flag.Int64Var(&maxBufferBytes, "max-buffer-bytes", 1<<20, "Maximum size of buffered request body (bytes), larger ones are not buffered and not retried")
+	flag.StringVar(&canaryURL, "canary-url", "", "Canary upstream to serve -canary-percent of clients instead of main pool, i.e. http://v2:8080")
+	flag.IntVar(&canaryPercent, "canary-percent", 0, "Percent of clients to route to -canary-url, clients are split by address")
+	flag.StringVar(&mirrorURL, "mirror-url", "", "Shadow upstream to send a copy of requests to, its responses are discarded, i.e. http://shadow:8080")
+	flag.Float64Var(&mirrorRatio, "mirror-ratio", 1, "Fraction of requests to mirror to -mirror-url, i.e. 0.1")
+	flag.Int64Var(&mirrorMaxBody, "mirror-max-body", 1<<20, "Maximum request body size to mirror (bytes), larger requests aren't mirrored")
+	flag.DurationVar(&mirrorTimeout, "mirror-timeout", 10*time.Second, "Timeout of requests to -mirror-url")
+	flag.StringVar(&upstreamProxy, "upstream-proxy", "", "HTTP proxy to reach upstreams through, i.e. http://corp:3128, overrides HTTP_PROXY environment")
+	flag.IntVar(&maxIdleConns, "max-idle-conns", 100, "Maximum number of idle upstream connections, 0 means no limit")
+	flag.IntVar(&maxIdleConnsPerHost, "max-idle-conns-per-host", http.DefaultMaxIdleConnsPerHost, "Maximum number of idle connections per upstream")
+	flag.DurationVar(&idleConnTimeout, "idle-conn-timeout", 90*time.Second, "Idle upstream connection timeout, 0 means no timeout")
+	flag.BoolVar(&disableKeepAlives, "disable-keepalives", false, "Use a fresh upstream connection for every request")
+	flag.DurationVar(&dialTimeout, "dial-timeout", 30*time.Second, "Upstream connect timeout, 0 means no timeout")
+	flag.DurationVar(&responseHeaderTimeout, "response-header-timeout", 0, "Time to wait for upstream response headers after request is written, 0 means no timeout")
+	flag.DurationVar(&expectContinueTimeout, "expect-continue-timeout", time.Second, "Time to wait for upstream 100 Continue before sending body of requests with Expect: 100-continue, 0 means send body immediately")
+	flag.StringVar(&socks5, "socks5", "", "SOCKS5 proxy to reach upstreams through, i.e. [user:pass@]host:1080")
+	flag.BoolVar(&upstreamHTTP2, "upstream-http2", false, "Speak HTTP/2 to plaintext upstreams (h2c), TLS upstreams negotiate HTTP/2 anyway")
+	flag.StringVar(&upstreamCAFile, "upstream-ca-file", "", "PEM file with CA certificates to verify TLS upstreams with instead of system ones")
+	flag.BoolVar(&grpcMode, "grpc", false, "Proxy gRPC calls: implies -h2c and -upstream-http2, streams responses and passes gRPC calls without timeout and response modifications")
+	flag.BoolVar(&h2cListener, "h2c", false, "Accept plaintext HTTP/2 (h2c) from clients, independent of -upstream-http2")
+	flag.StringVar(&adminPort, "admin-port", "", "Port to serve admin API on (prepended by colon), i.e. :9090, empty means disabled")
+	flag.BoolVar(&pprofEnabled, "pprof", false, "Serve net/http/pprof profiles on /debug/pprof/ of -admin-port")
+	flag.StringVar(&maintenanceFile, "maintenance-file", "", "Respond with 503 while this file exists, its content is served as maintenance page")
+	flag.StringVar(&livenessPath, "liveness-path", "", "Path to serve proxy liveness probe on, i.e. /healthz, empty means disabled")
+	flag.StringVar(&readinessPath, "readiness-path", "", "Path to serve proxy readiness probe on, i.e. /readyz, empty means disabled")
 	flag.Parse()
+	if err := setFlagsFromEnv(); err != nil {
+		log.Fatalf("Invalid environment: %v", err)
+	}
 
+	if showVersion {
+		fmt.Println(versionInfo())
+		return
+	}
 	if len(urls) == 0 {
-		panic("At least on URL has to be specified")
+		log.Fatalln("At least one URL has to be specified")
 	}
+	if xForwardedFor != "append" && xForwardedFor != "drop" {
+		log.Fatalf("Invalid -x-forwarded-for: %q, append or drop is expected", xForwardedFor)
+	}
+	if copyBufferSize < 0 {
+		log.Fatalf("Invalid -copy-buffer-size: %v, non-negative value is expected", copyBufferSize)
+	}
+	if retryJitter < 0 || retryJitter > 1 {
+		log.Fatalf("Invalid -retry-jitter: %v, value from 0 to 1 is expected", retryJitter)
+	}
+	if pprofEnabled && len(adminPort) == 0 {
+		log.Fatalln("Invalid -pprof: profiles are served on -admin-port only, so it has to be specified")
+	}
+	if trailingSlash != "add" && trailingSlash != "remove" && trailingSlash != "none" {
+		log.Fatalf("Invalid -trailing-slash: %q, add, remove or none is expected", trailingSlash)
+	}
+
+	clientIPHeaders = splitList(clientIPHeaderList)
 
+	var out io.Writer = os.Stdout
+	if len(logFile) > 0 {
+		out = newLogFile(logFile, logMaxSize, logMaxBackups)
+	}
 	l = logger.New(logger.Options{
 		Prefix:               prefix,
-		RemoteAddressHeaders: []string{"X-Forwarded-For"},
+		RemoteAddressHeaders: clientIPHeaders,
+		Out:                  out,
 		OutputFlags:          log.LstdFlags,
 	})
 
-	proxy := newProxy(urls.toURLs())
-	if dump {
-		proxy = dumpMiddleware(proxy)
+	upstreams, err := urls.toURLs()
+	if err != nil {
+		log.Fatalf("Invalid upstream URL: %v", err)
 	}
-	if verbose {
-		proxy = l.Handler(proxy)
+	retryStatuses, err := parseStatuses(retryOn)
+	if err != nil {
+		log.Fatalf("Invalid -retry-on-status: %v", err)
 	}
-
-	l.Printf("Proxy server is listening on port %s, upstreams = %s, timeout = %v ms, errorResponseCode = %v, followRedirects = %v, verbose = %v, dump = %v\n",
-		port, urls, timeout, errorResponseCode, followRedirects, verbose, dump)
-	l.Fatalln("ListenAndServe:", http.ListenAndServe(port, proxy))
-}
-
-func dumpMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		dump, err := httputil.DumpRequest(r, true)
+	trusted, err := parseCIDRs(trustedProxies)
+	if err != nil {
+		log.Fatalf("Invalid -trusted-proxies: %v", err)
+	}
+	if lbSeed == 0 {
+		lbSeed = time.Now().UnixNano()
+	}
+	balancer, err := newBalancer(lbStrategy, upstreams, weights, newLockedRand(lbSeed))
+	if err != nil {
+		log.Fatalf("Invalid load balancing settings: %v", err)
+	}
+	if grpcMode {
+		h2cListener, upstreamHTTP2 = true, true
+	}
+	transport, err := newTransport()
+	if err != nil {
+		log.Fatalf("Invalid upstream transport settings: %v", err)
+	}
+	config := &ProxyConfig{
+		Timeout:                  time.Duration(timeout),
+		PropagateDeadline:        propagateDeadline,
+		FollowRedirects:          followRedirects,
+		PreserveHost:             preserveHost,
+		GRPC:                     grpcMode,
+		SynthesizeHead:           synthesizeHead,
+		RawPath:                  rawPath,
+		XForwardedFor:            xForwardedFor,
+		UpstreamUserAgent:        upstreamUserAgent,
+		ForwardClientCert:        forwardClientCert,
+		ViaName:                  viaName,
+		ErrorResponseCode:        errorResponseCode,
+		TimeoutResponseCode:      timeoutResponseCode,
+		ConnectErrorCode:         connectErrorCode,
+		NoUpstreamCode:           noUpstreamCode,
+		ErrorResponseContentType: errorResponseContentType,
+		OverloadBody:             overloadResponseBody,
+		OverloadContentType:      overloadResponseContentType,
+		FallbackDir:              fallbackDir,
+		Retries:                  retries,
+		RetryStatuses:            retryStatuses,
+		RetryTruncated:           retryTruncated,
+		RetryBackoff:             retryBackoff,
+		RetryBackoffMax:          retryBackoffMax,
+		RetryJitter:              retryJitter,
+		MaxModifyBodyBytes:       maxModifyBodyBytes,
+		DumpResponse:             dumpResponse,
+		DumpMaxBytes:             dumpMaxBytes,
+		DumpRedact:               dumpRedact,
+		ExposeUpstreamHeader:     exposeUpstreamHeader,
+		HideBackendHeaders:       hideBackendHeaders,
+		Transport:                transport,
+		Balancer:                 balancer,
+		Logger:                   l,
+	}
+	if len(errorResponseFile) > 0 {
+		body, contentType, err := readErrorResponseFile(errorResponseFile)
 		if err != nil {
-			log.Printf("Failed to dump request: %v", err)
-		} else {
-			log.Println(string(dump))
+			log.Fatalf("Failed to read -error-response-file: %v", err)
 		}
-		next.ServeHTTP(w, r)
-	})
-}
-
-func newProxy(urls []*url.URL) http.Handler {
-	director := func(req *http.Request) {
-		u := loadBalance(urls)
-		req.URL.Scheme = u.Scheme
-		req.URL.Host = u.Host
-		req.URL.Path = singleJoiningSlash(u.Path, req.URL.Path)
-		req.Host = u.Host
-		if u.User != nil {
-			if pw, ok := u.User.Password(); ok {
-				req.SetBasicAuth(u.User.Username(), pw)
-			}
+		errorResponseBody = body
+		if len(config.ErrorResponseContentType) == 0 {
+			config.ErrorResponseContentType = contentType
 		}
-
-		if timeout > 0 {
-			ctx, _ := context.WithTimeout(req.Context(), time.Duration(timeout)*time.Millisecond)
-			req2 := req.WithContext(ctx)
-			*req = *req2
+	}
+	config.ErrorResponseBody = errorResponseBody
+	if strings.Contains(errorResponseBody, "{{") {
+		config.ErrorResponseTemplate, err = template.New("error").Parse(errorResponseBody)
+		if err != nil {
+			log.Fatalf("Invalid error response template: %v", err)
 		}
 	}
-
-	modifier := func(resp *http.Response) error {
-		if !followRedirects {
-			return nil
+	if len(bodyRewrites) > 0 {
+		config.BodyReplacer, err = newBodyReplacer(bodyRewrites)
+		if err != nil {
+			log.Fatalf("Invalid -body-rewrite: %v", err)
+		}
+		config.BodyRewriteMaxBytes = bodyRewriteMaxBytes
+	}
+	config.StatusRemaps, err = parseStatusRemaps(statusRemaps)
+	if err != nil {
+		log.Fatalf("Invalid -remap-status: %v", err)
+	}
+	config.OverrideBodies, err = parseOverrideBodies(overrideBodies)
+	if err != nil {
+		log.Fatalf("Invalid -override-body: %v", err)
+	}
+	config.CookieDomainRewrites, err = parseRewritePairs(cookieDomainRewrites)
+	if err != nil {
+		log.Fatalf("Invalid -cookie-domain-rewrite: %v", err)
+	}
+	config.CookiePathRewrites, err = parseRewritePairs(cookiePathRewrites)
+	if err != nil {
+		log.Fatalf("Invalid -cookie-path-rewrite: %v", err)
+	}
+	if len(credentialsFile) > 0 {
+		config.Credentials, err = loadCredentials(credentialsFile)
+		if err != nil {
+			log.Fatalf("Invalid -credentials-file: %v", err)
 		}
+	}
+	if cbFailureRatio > 0 {
+		config.Breakers = newBreakers(upstreams, cbFailureRatio, cbWindow, cbCooldown)
+	}
+	if copyBufferSize > 0 {
+		config.BufferPool = newBufferPool(copyBufferSize)
+	}
+	config.Stats = newStats(upstreams)
+	if statsInterval > 0 {
+		go config.Stats.report(statsInterval, nil)
+	}
+	if cacheTTL > 0 {
+		config.Cache = newResponseCache(cacheTTL, cacheMaxBytes, cacheStatusHeader)
+	}
+	if len(adminPort) > 0 {
+		config.Drains = newDrainSet()
+	}
 
-		u, err := resp.Location()
+	proxy := newProxy(upstreams, config)
+	if !earlyHints {
+		proxy = dropEarlyHintsMiddleware(proxy)
+	}
+	if bufferRequestBody {
+		proxy = bufferBodyMiddleware(proxy, maxBufferBytes)
+	}
+	if len(mirrorURL) > 0 {
+		mirrors := arrayFlags{mirrorURL}
+		mirror, err := mirrors.toURLs()
+		if err != nil {
+			log.Fatalf("Invalid -mirror-url: %v", err)
+		}
+		proxy = config.mirrorMiddleware(proxy, mirror[0], mirrorRatio, mirrorMaxBody, mirrorTimeout)
+	}
+	if maxPerUpstream > 0 {
+		proxy = inFlightMiddleware(proxy, config, upstreams, newInFlight(maxPerUpstream), maxPerUpstreamWait)
+	}
+	if coalesce {
+		proxy = coalesceMiddleware(proxy, coalesceMaxBody)
+	}
+	if config.Cache != nil {
+		proxy = config.Cache.middleware(proxy)
+	}
+	if len(canaryURL) > 0 {
+		canaries := arrayFlags{canaryURL}
+		canary, err := canaries.toURLs()
 		if err != nil {
-			switch err {
-			case http.ErrNoLocation:
-				return nil
-			default:
-				return err
+			log.Fatalf("Invalid -canary-url: %v", err)
+		}
+		proxy = canaryMiddleware(proxy, canary[0], canaryPercent)
+	}
+	if names := pathPlaceholders(upstreams); len(names) > 0 {
+		proxy = templateMiddleware(proxy, names)
+	}
+	if len(routes) > 0 {
+		var parsed []*route
+		for _, s := range routes {
+			r, err := parseRoute(s)
+			if err != nil {
+				log.Fatalf("Invalid -route: %v", err)
 			}
+			parsed = append(parsed, r)
 		}
+		proxy = routeMiddleware(proxy, config, parsed)
+	}
+	if allowUpstreamOverride {
+		proxy = upstreamOverrideMiddleware(proxy, upstreams)
+	}
+	var m *maintenance
+	if len(adminPort) > 0 || len(maintenanceFile) > 0 {
+		m = newMaintenance(maintenanceFile)
+		proxy = m.middleware(proxy)
+	}
+	if methods := splitList(strings.ToUpper(allowMethods)); len(methods) > 0 {
+		proxy = allowMethodsMiddleware(proxy, methods)
+	}
+	if prefixes := splitList(blockPaths); len(prefixes) > 0 {
+		proxy = blockPathMiddleware(proxy, prefixes, blockPathIgnoreCase)
+	}
+	if maxURIBytes > 0 {
+		proxy = maxURIBytesMiddleware(proxy, maxURIBytes)
+	}
+	if handlePreflight {
+		proxy = preflightMiddleware(proxy, &corsConfig{
+			origins: splitList(corsAllowOrigins),
+			methods: corsAllowMethods,
+			headers: corsAllowHeaders,
+			maxAge:  corsMaxAge,
+		})
+	}
+	if trailingSlash != "none" {
+		proxy = trailingSlashMiddleware(proxy, trailingSlash)
+	}
+	if len(statusPath) > 0 {
+		proxy = statusMiddleware(proxy, statusPath, upstreams, config.Breakers)
+	}
+	if len(livenessPath) > 0 || len(readinessPath) > 0 {
+		proxy = healthMiddleware(proxy, config, upstreams, livenessPath, readinessPath)
+	}
+	if maxConcurrent > 0 {
+		proxy = concurrencyLimitMiddleware(proxy, config, maxConcurrent, queueTimeout)
+	}
+	if dump {
+		proxy = dumpMiddleware(proxy, config)
+	}
+	if verbose {
+		proxy = l.Handler(proxy)
+	}
+	if logTimings {
+		proxy = timingLogMiddleware(proxy)
+	}
+	if slowThreshold > 0 {
+		proxy = slowLogMiddleware(proxy, slowThreshold)
+	}
+	proxy = config.Stats.middleware(proxy, verbose)
+	proxy = forwardedHeadersMiddleware(proxy, trusted, clobberForwarded, splitList(stripRequestHeaders))
+	if writeTimeout > 0 {
+		proxy = streamingMiddleware(proxy, streamWriteTimeout)
+	}
+	if h2cListener {
+		proxy = h2c.NewHandler(proxy, &http2.Server{})
+	}
 
-		r, err := http.Get(u.String())
+	server := &http.Server{Handler: proxy, MaxHeaderBytes: maxHeaderBytes, WriteTimeout: writeTimeout, IdleTimeout: idleTimeout}
+	if len(tlsCert) > 0 || len(tlsKey) > 0 {
+		server.TLSConfig, err = newServerTLSConfig(tlsCert, tlsKey, clientCAFile, requireClientCert)
 		if err != nil {
-			return err
+			log.Fatalf("Invalid TLS settings: %v", err)
 		}
-
-		cloneResponse(resp, r)
-		return nil
 	}
 
-	errorHandler := func(rw http.ResponseWriter, req *http.Request, err error) {
-		l.Printf("Proxy error: %v\n", err)
-		rw.WriteHeader(errorResponseCode)
-		if len(errorResponseBody) > 0 {
-			if _, err := rw.Write([]byte(errorResponseBody)); err != nil {
-				l.Println(err)
-			}
-		}
+	if dryRun {
+		fmt.Printf("Configuration is valid, port = %s, upstreams = %s\n", port, urls)
+		return
 	}
 
-	return &httputil.ReverseProxy{
-		Director:       director,
-		ModifyResponse: modifier,
-		ErrorHandler:   errorHandler,
+	if len(adminPort) > 0 {
+		go func() {
+			l.Printf("Admin server is listening on port %s\n", adminPort)
+			l.Fatalln("Admin ListenAndServe:", http.ListenAndServe(adminPort, adminHandler(upstreams, config.Drains, m, pprofEnabled)))
+		}()
 	}
-}
 
-func loadBalance(targets []*url.URL) *url.URL {
-	return targets[rand.Int()%len(targets)]
-}
+	if waitForUpstreamsFlag {
+		waitForUpstreams(upstreams, waitTimeout)
+	}
 
-func cloneResponse(to, from *http.Response) {
-	to.Status = from.Status
-	to.StatusCode = from.StatusCode
-	to.Body = from.Body
-	to.ContentLength = from.ContentLength
-	headers := []string{"Content-Length", "Content-Encoding", "Content-Type"}
-	for _, h := range headers {
-		replaceHeader(to, from, h)
+	l.Printf("Proxy server is listening on port %s, upstreams = %s, timeout = %v, errorResponseCode = %v, followRedirects = %v, preserveHost = %v, verbose = %v, dump = %v\n",
+		port, urls, timeout, errorResponseCode, followRedirects, preserveHost, verbose, dump)
+	ln, err := listen(port, tcpKeepAlive, maxConnections)
+	if err != nil {
+		l.Fatalln("Listen:", err)
 	}
-	to.Header.Del("Location")
+	go func() {
+		var err error
+		if server.TLSConfig != nil {
+			err = server.ServeTLS(ln, "", "")
+		} else {
+			err = server.Serve(ln)
+		}
+		if err != http.ErrServerClosed {
+			l.Fatalln("Serve:", err)
+		}
+	}()
+	shutdownOnSignal(server, preShutdownDelay, shutdownTimeout)
 }
 
-func replaceHeader(to, from *http.Response, header string) {
-	if from.Header.Get(header) != "" {
-		to.Header.Set(header, from.Header.Get(header))
-	} else {
-		to.Header.Del(header)
-	}
+// versionInfo describes build of the binary
+func versionInfo() string {
+	return fmt.Sprintf("httproxy %s, commit %s, built at %s", version, commit, buildDate)
 }
 
 // Taken from net/http/httputil/reverseproxy.go
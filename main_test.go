@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/unrolled/logger"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// mainArgsEnv passes command line to main run by test binary in a child process, one argument per line
+const mainArgsEnv = "HTTPROXY_TEST_MAIN_ARGS"
+
+func TestMain(m *testing.M) {
+	if args, ok := os.LookupEnv(mainArgsEnv); ok {
+		os.Args = append(os.Args[:1], strings.Split(args, "\n")...)
+		flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+		main()
+		os.Exit(0)
+	}
+	l = logger.New(logger.Options{Out: io.Discard})
+	os.Exit(m.Run())
+}
+
+// runMain runs main with args in a child process and returns its output
+func runMain(t *testing.T, env []string, args ...string) (string, error) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(append(os.Environ(), mainArgsEnv+"="+strings.Join(args, "\n")), env...)
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+// testConfig returns proxy config with defaults of command line flags
+func testConfig() *ProxyConfig {
+	return &ProxyConfig{
+		ErrorResponseCode:   http.StatusBadGateway,
+		TimeoutResponseCode: http.StatusGatewayTimeout,
+		ConnectErrorCode:    http.StatusBadGateway,
+		NoUpstreamCode:      http.StatusServiceUnavailable,
+		Transport:           http.DefaultTransport.(*http.Transport).Clone(),
+		Balancer:            randomBalancer{newLockedRand(1)},
+		Stats:               newStats(nil),
+		Logger:              l,
+	}
+}
+
+// backendURLs returns URLs of test servers to proxy to
+func backendURLs(t *testing.T, servers ...*httptest.Server) []*url.URL {
+	t.Helper()
+	var urls []*url.URL
+	for _, s := range servers {
+		u, err := url.Parse(s.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		urls = append(urls, u)
+	}
+	return urls
+}
+
+// serve passes request to handler and returns recorded response with its body
+func serve(h http.Handler, req *http.Request) (*http.Response, string) {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	resp := rec.Result()
+	body, _ := io.ReadAll(resp.Body)
+	return resp, string(body)
+}
+
+// setGlobal sets flag variable p to v until the test ends
+func setGlobal[T any](t *testing.T, p *T, v T) {
+	prev := *p
+	*p = v
+	t.Cleanup(func() { *p = prev })
+}
+
+func TestToURLsReturnsParseError(t *testing.T) {
+	flags := arrayFlags{"http://localhost:8081", "http://[::1"}
+	urls, err := flags.toURLs()
+	if err == nil {
+		t.Fatalf("unparseable URL is accepted as %v", urls)
+	}
+	if !strings.Contains(err.Error(), "http://[::1") {
+		t.Errorf("error %q doesn't name invalid URL", err)
+	}
+}
+
+func TestToURLsValidatesSchemeAndHost(t *testing.T) {
+	for _, tt := range []struct {
+		url, err string
+	}{
+		{"localhost:8081", "unsupported scheme"},
+		{"ftp://files.example.com", "unsupported scheme"},
+		{"http://", "host is missing"},
+		{"https:///path", "host is missing"},
+	} {
+		_, err := (&arrayFlags{tt.url}).toURLs()
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error = %v, want %q", tt.url, err, tt.err)
+		}
+	}
+	if _, err := (&arrayFlags{"http://localhost:8081", "https://example.com/api"}).toURLs(); err != nil {
+		t.Errorf("valid URLs are rejected: %v", err)
+	}
+}
+
+// h2cClient speaks HTTP/2 with prior knowledge to plaintext servers
+func h2cClient() *http.Client {
+	return &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}}
+}
+
+func TestH2CListener(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("over " + r.Proto))
+	}))
+	defer backend.Close()
+	proxy := httptest.NewServer(h2c.NewHandler(newProxy(backendURLs(t, backend), testConfig()), &http2.Server{}))
+	defer proxy.Close()
+
+	resp, err := h2cClient().Get(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.Proto != "HTTP/2.0" || string(body) != "over HTTP/1.1" {
+		t.Errorf("client got %q over %s, want upstream HTTP/1.1 response over HTTP/2.0", body, resp.Proto)
+	}
+}
+
+// namedBackend responds with its name
+func namedBackend(name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(name))
+	}))
+}
+
+func TestVersionInfo(t *testing.T) {
+	setGlobal(t, &version, "v1.2.3")
+	setGlobal(t, &commit, "abc1234")
+	setGlobal(t, &buildDate, "2024-01-02T03:04:05Z")
+	if got, want := versionInfo(), "httproxy v1.2.3, commit abc1234, built at 2024-01-02T03:04:05Z"; got != want {
+		t.Errorf("version = %q, want %q", got, want)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	for _, tt := range []struct {
+		args  []string
+		valid bool
+		out   string
+	}{
+		{[]string{"-dry-run", "-url", "http://localhost:8081"}, true, "Configuration is valid"},
+		{[]string{"-dry-run", "-url", "ftp://localhost:8081"}, false, "unsupported scheme"},
+		{[]string{"-dry-run", "-url", "http://localhost:8081", "-upstream-ca-file", "missing.pem"}, false, "Invalid upstream transport settings"},
+		{[]string{"-dry-run", "-url", "http://localhost:8081", "-tls-cert", "missing.pem", "-tls-key", "missing.key"}, false, "Invalid TLS settings"},
+	} {
+		out, err := runMain(t, nil, tt.args...)
+		if (err == nil) != tt.valid || !strings.Contains(out, tt.out) {
+			t.Errorf("%v: err = %v, output = %q, want %q", tt.args, err, out, tt.out)
+		}
+	}
+}
+
+func TestMillisDuration(t *testing.T) {
+	for _, tt := range []struct {
+		value string
+		want  time.Duration
+	}{
+		{"30s", 30 * time.Second},
+		{"30000", 30 * time.Second},
+		{"1m30s", 90 * time.Second},
+		{"250ms", 250 * time.Millisecond},
+		{"0", 0},
+	} {
+		var d millisDuration
+		if err := d.Set(tt.value); err != nil || time.Duration(d) != tt.want {
+			t.Errorf("%q: duration = %v, err = %v, want %v", tt.value, time.Duration(d), err, tt.want)
+		}
+	}
+	var d millisDuration
+	if err := d.Set("30 seconds"); err == nil {
+		t.Errorf("invalid duration is parsed as %v", time.Duration(d))
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Interval to check maintenance sentinel file existence with
+const maintenancePollInterval = time.Second
+
+const defaultMaintenanceBody = "Service is under maintenance\n"
+
+// maintenance is active when it's switched on via admin API or sentinel file exists,
+// content of sentinel file if any is served as maintenance page
+type maintenance struct {
+	mu         sync.RWMutex
+	switchedOn bool
+	fileBody   []byte
+	fileExists bool
+}
+
+func newMaintenance(file string) *maintenance {
+	m := &maintenance{}
+	if len(file) > 0 {
+		m.poll(file)
+		go func() {
+			for range time.Tick(maintenancePollInterval) {
+				m.poll(file)
+			}
+		}()
+	}
+	return m
+}
+
+func (m *maintenance) poll(file string) {
+	body, err := os.ReadFile(file)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fileExists = err == nil
+	m.fileBody = body
+}
+
+func (m *maintenance) set(on bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.switchedOn = on
+}
+
+// page returns maintenance page body and whether maintenance is active
+func (m *maintenance) page() ([]byte, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.fileBody) > 0 {
+		return m.fileBody, m.fileExists || m.switchedOn
+	}
+	return []byte(defaultMaintenanceBody), m.fileExists || m.switchedOn
+}
+
+func (m *maintenance) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, active := m.page()
+		if !active {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", http.DetectContentType(body))
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		if _, err := w.Write(body); err != nil {
+			l.Println(err)
+		}
+	})
+}
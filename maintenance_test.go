@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMaintenanceToggledByAdmin(t *testing.T) {
+	backend := namedBackend("backend")
+	defer backend.Close()
+	urls := backendURLs(t, backend)
+	m := newMaintenance("")
+	proxy := m.middleware(newProxy(urls, testConfig()))
+	admin := adminHandler(urls, newDrainSet(), m, false)
+
+	if resp, _ := serve(admin, httptest.NewRequest(http.MethodPost, "/admin/maintenance?enabled=true", nil)); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("enabling maintenance: status = %d, want 204", resp.StatusCode)
+	}
+	resp, body := serve(proxy, httptest.NewRequest(http.MethodGet, "/", nil))
+	if resp.StatusCode != http.StatusServiceUnavailable || body != defaultMaintenanceBody || len(resp.Header.Get("Retry-After")) == 0 {
+		t.Errorf("under maintenance: status = %d, body = %q, Retry-After = %q", resp.StatusCode, body, resp.Header.Get("Retry-After"))
+	}
+
+	if resp, _ := serve(admin, httptest.NewRequest(http.MethodPost, "/admin/maintenance?enabled=false", nil)); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("disabling maintenance: status = %d, want 204", resp.StatusCode)
+	}
+	if _, body := serve(proxy, httptest.NewRequest(http.MethodGet, "/", nil)); body != "backend" {
+		t.Errorf("after maintenance: body = %q, want upstream response", body)
+	}
+}
+
+func TestMaintenanceFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "maintenance.html")
+	if err := os.WriteFile(name, []byte("<h1>Back soon</h1>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m := newMaintenance(name)
+	proxy := m.middleware(http.NotFoundHandler())
+
+	resp, body := serve(proxy, httptest.NewRequest(http.MethodGet, "/", nil))
+	if resp.StatusCode != http.StatusServiceUnavailable || body != "<h1>Back soon</h1>" {
+		t.Errorf("status = %d, body = %q, want maintenance page from file", resp.StatusCode, body)
+	}
+	os.Remove(name)
+	m.poll(name)
+	if resp, _ := serve(proxy, httptest.NewRequest(http.MethodGet, "/", nil)); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("after file removal: status = %d, want request passed through", resp.StatusCode)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAllowMethods(t *testing.T) {
+	backend := namedBackend("backend")
+	defer backend.Close()
+	proxy := allowMethodsMiddleware(newProxy(backendURLs(t, backend), testConfig()), splitList("GET,HEAD,OPTIONS"))
+
+	for _, tt := range []struct {
+		method string
+		want   int
+	}{
+		{http.MethodGet, http.StatusOK},
+		{http.MethodHead, http.StatusOK},
+		{http.MethodOptions, http.StatusOK},
+		{http.MethodPost, http.StatusMethodNotAllowed},
+		{http.MethodDelete, http.StatusMethodNotAllowed},
+	} {
+		resp, _ := serve(proxy, httptest.NewRequest(tt.method, "/", nil))
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.method, resp.StatusCode, tt.want)
+		}
+		allow := resp.Header.Get("Allow")
+		if tt.want == http.StatusMethodNotAllowed && allow != "GET, HEAD, OPTIONS" {
+			t.Errorf("%s: Allow = %q, want GET, HEAD, OPTIONS", tt.method, allow)
+		}
+	}
+}
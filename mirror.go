@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// mirrorMiddleware sends a copy of ratio fraction of requests to shadow upstream u in background,
+// shadow responses are discarded and its errors are only logged, requests with body larger than maxBytes
+// aren't mirrored and shadow round trip is canceled after timeout
+func (c *ProxyConfig) mirrorMiddleware(next http.Handler, u *url.URL, ratio float64, maxBytes int64, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rand.Float64() >= ratio || r.ContentLength > maxBytes {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var body []byte
+		if r.Body != nil && r.Body != http.NoBody {
+			var err error
+			body, err = io.ReadAll(io.LimitReader(r.Body, maxBytes+1))
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+			if int64(len(body)) > maxBytes {
+				r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+				next.ServeHTTP(w, r)
+				return
+			}
+			r.Body.Close()
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		mirrorReq := r.Clone(ctx)
+		mirrorReq.RequestURI = ""
+		c.directTo(mirrorReq, u, r.URL.Path, r.URL.RawPath)
+		for _, h := range hopHeaders {
+			mirrorReq.Header.Del(h)
+		}
+		if body != nil {
+			mirrorReq.Body = io.NopCloser(bytes.NewReader(body))
+			mirrorReq.ContentLength = int64(len(body))
+		}
+		go func() {
+			defer cancel()
+			resp, err := c.Transport.RoundTrip(mirrorReq)
+			if err != nil {
+				c.Logger.Printf("Mirror error: upstream = %s, %v\n", u.Redacted(), err)
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
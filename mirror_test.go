@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMirrorSendsShadowCopy(t *testing.T) {
+	mirrored := make(chan string, 10)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mirrored <- string(body)
+	}))
+	defer shadow.Close()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer backend.Close()
+	c := testConfig()
+	u := backendURLs(t, shadow)[0]
+
+	for _, tt := range []struct {
+		ratio    float64
+		body     string
+		mirrored bool
+	}{
+		{1, "payload", true},
+		{1, "payload over limit", false},
+		{0, "payload", false},
+	} {
+		proxy := c.mirrorMiddleware(newProxy(backendURLs(t, backend), c), u, tt.ratio, 16, time.Second)
+		resp, body := serve(proxy, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body)))
+		if resp.StatusCode != http.StatusOK || body != tt.body {
+			t.Errorf("ratio %v, body %q: status = %d, body = %q, want upstream to get whole body", tt.ratio, tt.body, resp.StatusCode, body)
+		}
+		select {
+		case got := <-mirrored:
+			if !tt.mirrored || got != tt.body {
+				t.Errorf("ratio %v, body %q: shadow got %q", tt.ratio, tt.body, got)
+			}
+		case <-time.After(200 * time.Millisecond):
+			if tt.mirrored {
+				t.Errorf("ratio %v, body %q: request isn't mirrored", tt.ratio, tt.body)
+			}
+		}
+	}
+}
+
+func TestMirrorTimeout(t *testing.T) {
+	canceled := make(chan struct{})
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			close(canceled)
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer shadow.Close()
+	backend := namedBackend("backend")
+	defer backend.Close()
+	c := testConfig()
+	proxy := c.mirrorMiddleware(newProxy(backendURLs(t, backend), c), backendURLs(t, shadow)[0], 1, 16, 50*time.Millisecond)
+
+	if _, body := serve(proxy, httptest.NewRequest(http.MethodGet, "/", nil)); body != "backend" {
+		t.Errorf("body = %q, want response of main upstream", body)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(2 * time.Second):
+		t.Error("shadow request isn't canceled after timeout")
+	}
+}
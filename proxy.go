@@ -0,0 +1,580 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/unrolled/logger"
+	"golang.org/x/net/http/httpguts"
+)
+
+// ProxyConfig holds settings of a single proxy instance
+type ProxyConfig struct {
+	Timeout                  time.Duration
+	PropagateDeadline        bool
+	FollowRedirects          bool
+	PreserveHost             bool
+	GRPC                     bool
+	SynthesizeHead           bool
+	RawPath                  bool
+	XForwardedFor            string
+	UpstreamUserAgent        string
+	Credentials              map[string]*url.Userinfo
+	ForwardClientCert        bool
+	ViaName                  string
+	ErrorResponseCode        int
+	TimeoutResponseCode      int
+	ConnectErrorCode         int
+	NoUpstreamCode           int
+	ErrorResponseBody        string
+	ErrorResponseContentType string
+	OverloadBody             string
+	OverloadContentType      string
+	ErrorResponseTemplate    *template.Template
+	FallbackDir              string
+	Retries                  int
+	RetryStatuses            map[int]bool
+	RetryTruncated           bool
+	RetryBackoff             time.Duration
+	RetryBackoffMax          time.Duration
+	RetryJitter              float64
+	DumpResponse             bool
+	DumpMaxBytes             int64
+	DumpRedact               string
+	ExposeUpstreamHeader     string
+	HideBackendHeaders       bool
+	BodyReplacer             *strings.Replacer
+	BodyRewriteMaxBytes      int64
+	MaxModifyBodyBytes       int64
+	StatusRemaps             map[int]int
+	OverrideBodies           map[int]string
+	CookieDomainRewrites     []rewritePair
+	CookiePathRewrites       []rewritePair
+	Transport                http.RoundTripper
+	BufferPool               httputil.BufferPool
+	Balancer                 Balancer
+	Breakers                 map[*url.URL]*breaker
+	Drains                   *drainSet
+	Cache                    *responseCache
+	Stats                    *stats
+	Logger                   *logger.Logger
+}
+
+// upstreamFrom returns upstream chosen for request by director
+func upstreamFrom(ctx context.Context) (*url.URL, bool) {
+	u, ok := ctx.Value(upstreamKey).(*url.URL)
+	return u, ok
+}
+
+func (c *ProxyConfig) recordResult(u *url.URL, success bool) {
+	if b, ok := c.Breakers[u]; ok {
+		b.record(success)
+	}
+}
+
+// isGRPC reports whether request is a gRPC call which must be streamed as is
+func isGRPC(req *http.Request) bool {
+	return strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc")
+}
+
+// isUpgrade reports whether request asks to switch protocol, i.e. to WebSocket, so the connection is long-lived
+func isUpgrade(req *http.Request) bool {
+	return httpguts.HeaderValuesContainsToken(req.Header["Connection"], "upgrade")
+}
+
+// recordLatency passes upstream response time to balancer if it takes latency into account
+func (c *ProxyConfig) recordLatency(ctx context.Context, u *url.URL) {
+	o, ok := c.Balancer.(latencyObserver)
+	if !ok {
+		return
+	}
+	if start, ok := ctx.Value(startKey).(time.Time); ok {
+		o.observe(u, time.Since(start))
+	}
+}
+
+func newProxy(urls []*url.URL, c *ProxyConfig) http.Handler {
+	rewrite := func(pr *httputil.ProxyRequest) {
+		req := pr.Out
+		u, ok := req.Context().Value(overrideKey).(*url.URL)
+		if !ok {
+			u = c.loadBalance(upstreams(req.Context(), urls))
+		}
+		if u == nil {
+			// Without upstream in context the request fails with errNoUpstream in transport
+			return
+		}
+		if c.Stats != nil {
+			c.Stats.proxiedTo(u)
+		}
+		path, rawPath := req.URL.Path, req.URL.RawPath
+		c.directTo(req, u, path, rawPath)
+		synthesizedHead := c.SynthesizeHead && req.Method == http.MethodHead
+		if synthesizedHead {
+			req.Method = http.MethodGet
+		}
+		c.setXForwardedFor(pr)
+		keepForwarded(pr)
+		if c.ForwardClientCert {
+			setClientCertHeaders(pr.In, req)
+		}
+		if len(c.ViaName) > 0 {
+			appendVia(req.Header, pr.In.ProtoMajor, pr.In.ProtoMinor, c.ViaName)
+		}
+		if len(c.UpstreamUserAgent) > 0 {
+			req.Header.Del("X-Original-User-Agent")
+			if ua := pr.In.Header.Get("User-Agent"); len(ua) > 0 {
+				req.Header.Set("X-Original-User-Agent", ua)
+			}
+			req.Header.Set("User-Agent", c.UpstreamUserAgent)
+		}
+
+		noteUpstream(req.Context(), u)
+		ctx := context.WithValue(req.Context(), upstreamKey, u)
+		ctx = context.WithValue(ctx, pathKey, path)
+		ctx = context.WithValue(ctx, rawPathKey, rawPath)
+		ctx = context.WithValue(ctx, startKey, time.Now())
+		ctx = withTimingsTrace(ctx)
+		if synthesizedHead {
+			ctx = context.WithValue(ctx, headKey, true)
+		}
+		if timeout := c.timeout(ctx); timeout > 0 && !(c.GRPC && isGRPC(pr.In)) && !isUpgrade(pr.In) {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			ctx = context.WithValue(ctx, cancelKey, cancel)
+		}
+		pr.Out = req.WithContext(ctx)
+		if c.PropagateDeadline {
+			setDeadlineHeader(pr.Out)
+		}
+	}
+
+	modifier := func(resp *http.Response) error {
+		if u, ok := upstreamFrom(resp.Request.Context()); ok {
+			c.recordResult(u, resp.StatusCode < http.StatusInternalServerError)
+			c.recordLatency(resp.Request.Context(), u)
+		}
+
+		if c.GRPC && isGRPC(resp.Request) {
+			return nil
+		}
+
+		// Body of switched protocol response is the upgraded connection which must be passed as is
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			return nil
+		}
+
+		if len(c.RetryStatuses) > 0 {
+			c.retryOnStatus(resp, urls)
+		}
+
+		if c.RetryTruncated {
+			c.retryOnTruncation(resp, urls)
+		}
+
+		// body of unknown length is peeked at only when it may be modified, event streams never are
+		var modifiable bool
+		if c.modifiesBody() && !isEventStream(resp.Header.Get("Content-Type")) {
+			var err error
+			if modifiable, err = c.fitsModifyLimit(resp); err != nil {
+				return err
+			}
+		}
+
+		if c.FollowRedirects && modifiable {
+			if err := c.followRedirect(resp); err != nil {
+				return err
+			}
+		}
+
+		if c.BodyReplacer != nil && modifiable {
+			if err := c.rewriteBody(resp); err != nil {
+				return err
+			}
+		}
+
+		if len(c.StatusRemaps) > 0 {
+			c.remapStatus(resp)
+		}
+
+		if len(c.OverrideBodies) > 0 && modifiable {
+			c.overrideBody(resp)
+		}
+
+		if len(c.ViaName) > 0 {
+			appendVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor, c.ViaName)
+		}
+
+		if len(c.CookieDomainRewrites) > 0 || len(c.CookiePathRewrites) > 0 {
+			c.rewriteCookies(resp)
+		}
+
+		if c.HideBackendHeaders {
+			for _, h := range backendHeaders {
+				resp.Header.Del(h)
+			}
+		}
+
+		if len(c.ExposeUpstreamHeader) > 0 {
+			if u, ok := upstreamFrom(resp.Request.Context()); ok {
+				resp.Header.Set(c.ExposeUpstreamHeader, u.Host)
+			}
+		}
+
+		if c.Cache != nil {
+			if err := c.Cache.store(resp); err != nil {
+				return err
+			}
+		}
+
+		if c.DumpResponse {
+			c.dumpUpstreamResponse(resp)
+		}
+
+		if _, ok := resp.Request.Context().Value(headKey).(bool); ok {
+			if err := discardBody(resp); err != nil {
+				return err
+			}
+		}
+
+		if u, ok := upstreamFrom(resp.Request.Context()); ok {
+			resp.Body = &truncationLogger{ReadCloser: resp.Body, logger: c.Logger, upstream: u}
+		}
+
+		if cancel, ok := resp.Request.Context().Value(cancelKey).(context.CancelFunc); ok {
+			resp.Body = cancelOnClose{resp.Body, cancel}
+		}
+		return nil
+	}
+
+	errorHandler := func(rw http.ResponseWriter, req *http.Request, err error) {
+		if cancel, ok := req.Context().Value(cancelKey).(context.CancelFunc); ok {
+			defer cancel()
+		}
+		if u, ok := upstreamFrom(req.Context()); ok {
+			c.recordResult(u, false)
+			c.Logger.Printf("Proxy error: upstream = %s, error_type = %s, %v\n", u.Redacted(), errorType(err), err)
+		} else {
+			c.Logger.Printf("Proxy error: error_type = %s, %v\n", errorType(err), err)
+		}
+		if len(c.FallbackDir) > 0 && c.serveFallback(rw, req) {
+			return
+		}
+		c.writeErrorResponse(rw, req, c.errorCode(req.Context(), err), err)
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite:        rewrite,
+		ModifyResponse: modifier,
+		ErrorHandler:   errorHandler,
+		Transport:      resetRetryTransport{c, urls},
+		BufferPool:     c.BufferPool,
+	}
+	if c.GRPC {
+		proxy.FlushInterval = -1
+	}
+	return proxy
+}
+
+// backendHeaders reveal upstream software and are dropped from responses with HideBackendHeaders
+var backendHeaders = []string{"Server", "X-Powered-By", "X-AspNet-Version", "X-AspNetMvc-Version"}
+
+const deadlineHeader = "X-Request-Deadline"
+
+// setDeadlineHeader passes milliseconds left until request context deadline to upstream, so it may shed work
+// it can't finish in time, requests without deadline are passed as is
+func setDeadlineHeader(req *http.Request) {
+	if deadline, ok := req.Context().Deadline(); ok {
+		req.Header.Set(deadlineHeader, strconv.FormatInt(time.Until(deadline).Milliseconds(), 10))
+	}
+}
+
+// errNoUpstream is returned by transport for requests no upstream was picked for
+var errNoUpstream = errors.New("no upstream is available")
+
+// errorCode returns response code for proxy error, the catch-all ErrorResponseCode is overridden by matched route
+func (c *ProxyConfig) errorCode(ctx context.Context, err error) int {
+	if errors.Is(err, errNoUpstream) {
+		if c.NoUpstreamCode > 0 {
+			return c.NoUpstreamCode
+		}
+		return http.StatusServiceUnavailable
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return c.ConnectErrorCode
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return c.TimeoutResponseCode
+	}
+	if rt, ok := routeFrom(ctx); ok && rt.errorCode > 0 {
+		return rt.errorCode
+	}
+	return c.ErrorResponseCode
+}
+
+type errorResponseData struct {
+	Error      string
+	Upstream   string
+	StatusCode int
+}
+
+func (c *ProxyConfig) writeErrorResponse(rw http.ResponseWriter, req *http.Request, code int, err error) {
+	body := []byte(c.ErrorResponseBody)
+	if c.ErrorResponseTemplate != nil {
+		data := errorResponseData{Error: err.Error(), StatusCode: code}
+		if u, ok := upstreamFrom(req.Context()); ok {
+			data.Upstream = u.Redacted()
+		}
+		var buf bytes.Buffer
+		if err := c.ErrorResponseTemplate.Execute(&buf, data); err != nil {
+			c.Logger.Println(err)
+		}
+		body = buf.Bytes()
+	}
+
+	if len(c.ErrorResponseContentType) > 0 {
+		rw.Header().Set("Content-Type", c.ErrorResponseContentType)
+	}
+	rw.WriteHeader(code)
+	if len(body) > 0 {
+		if _, err := rw.Write(body); err != nil {
+			c.Logger.Println(err)
+		}
+	}
+}
+
+// readErrorResponseFile reads error response body from file, content type is detected by file extension
+func readErrorResponseFile(name string) (string, string, error) {
+	body, err := os.ReadFile(name)
+	if err != nil {
+		return "", "", err
+	}
+	return string(body), mime.TypeByExtension(filepath.Ext(name)), nil
+}
+
+// serveFallback serves file matching incoming request path or index.html from FallbackDir,
+// it reports whether any file is served
+func (c *ProxyConfig) serveFallback(rw http.ResponseWriter, req *http.Request) bool {
+	path, _ := req.Context().Value(pathKey).(string)
+	for _, name := range []string{path, "/index.html"} {
+		f, err := http.Dir(c.FallbackDir).Open(name)
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil || fi.IsDir() {
+			continue
+		}
+		http.ServeContent(rw, req, fi.Name(), fi.ModTime(), f)
+		return true
+	}
+	return false
+}
+
+// setXForwardedFor sets X-Forwarded-For of outgoing request which is removed by ReverseProxy before Rewrite
+func (c *ProxyConfig) setXForwardedFor(pr *httputil.ProxyRequest) {
+	if c.XForwardedFor == "drop" {
+		return
+	}
+	clientIP, _, err := net.SplitHostPort(pr.In.RemoteAddr)
+	if err != nil {
+		return
+	}
+	prior := pr.In.Header["X-Forwarded-For"]
+	pr.Out.Header.Set("X-Forwarded-For", strings.Join(append(prior, clientIP), ", "))
+}
+
+// keepForwarded passes forwarding headers removed by ReverseProxy before Rewrite as they are received,
+// the ones sent by untrusted peers are already dropped by forwardedHeadersMiddleware
+func keepForwarded(pr *httputil.ProxyRequest) {
+	for _, h := range []string{"X-Forwarded-Host", "X-Forwarded-Proto", "Forwarded"} {
+		if values, ok := pr.In.Header[h]; ok {
+			pr.Out.Header[h] = values
+		}
+	}
+}
+
+// appendVia appends proxy to Via header received with protocol version major.minor
+func appendVia(h http.Header, major, minor int, name string) {
+	via := fmt.Sprintf("%d.%d %s", major, minor, name)
+	if prior := h.Values("Via"); len(prior) > 0 {
+		via = strings.Join(prior, ", ") + ", " + via
+	}
+	h.Set("Via", via)
+}
+
+// directTo points request to upstream u, path and rawPath are an incoming request path and its original encoding.
+// Placeholders in upstream path are expanded with values resolved by templateMiddleware.
+// Original encoding is passed to upstream as is with RawPath, otherwise it's kept only if it is still valid for joined path.
+func (c *ProxyConfig) directTo(req *http.Request, u *url.URL, path, rawPath string) {
+	base := &url.URL{Path: u.Path, RawPath: u.RawPath}
+	if values, ok := req.Context().Value(templateKey).(map[string]string); ok {
+		base = &url.URL{Path: expandPath(u.Path, values)}
+	}
+	req.URL.Scheme = u.Scheme
+	req.URL.Host = u.Host
+	req.URL.Path = singleJoiningSlash(base.Path, path)
+	req.URL.RawPath = rawPath
+	if c.RawPath && len(rawPath) > 0 {
+		req.URL.RawPath = singleJoiningSlash(base.EscapedPath(), rawPath)
+	}
+	if !c.PreserveHost {
+		req.Host = u.Host
+	}
+	user := u.User
+	if user == nil {
+		user = c.Credentials[u.Host]
+	}
+	if user != nil {
+		if pw, ok := user.Password(); ok {
+			req.SetBasicAuth(user.Username(), pw)
+		}
+	}
+}
+
+func (c *ProxyConfig) followRedirect(resp *http.Response) error {
+	// Location of other responses, i.e. 201 Created, is a resource URL rather than a redirect
+	if resp.StatusCode < 300 || resp.StatusCode > 399 {
+		return nil
+	}
+	u, err := resp.Location()
+	if err != nil {
+		switch err {
+		case http.ErrNoLocation:
+			return nil
+		default:
+			return err
+		}
+	}
+
+	client := &http.Client{Transport: c.Transport}
+	r, err := client.Get(u.String())
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+	cloneResponse(resp, r)
+	return nil
+}
+
+// available returns targets loadBalance picks from, i.e. not drained upstreams without open circuit breaker,
+// upstreams without circuit breaker are always available
+func (c *ProxyConfig) available(targets []*url.URL) []*url.URL {
+	active := targets
+	if c.Drains != nil {
+		active = c.Drains.active(targets)
+	}
+	if c.Breakers == nil {
+		return active
+	}
+	var candidates []*url.URL
+	for _, t := range active {
+		if b, ok := c.Breakers[t]; !ok || b.available() {
+			candidates = append(candidates, t)
+		}
+	}
+	return candidates
+}
+
+// loadBalance picks an available upstream with balancer, if there is none nil is returned when NoUpstreamCode is set,
+// otherwise any not drained upstream or any upstream at all may be picked
+func (c *ProxyConfig) loadBalance(targets []*url.URL) *url.URL {
+	candidates := c.available(targets)
+	for len(candidates) > 0 {
+		u := c.Balancer.Pick(candidates)
+		if b, ok := c.Breakers[u]; !ok || b.allow() {
+			return u
+		}
+		candidates = exclude(candidates, []*url.URL{u})
+	}
+	if c.NoUpstreamCode > 0 || len(targets) == 0 {
+		return nil
+	}
+	active := targets
+	if c.Drains != nil {
+		active = c.Drains.active(targets)
+	}
+	if len(active) == 0 {
+		active = targets
+	}
+	return c.Balancer.Pick(active)
+}
+
+// truncationLogger logs upstream closing connection before sending the whole body,
+// at that point response headers and part of body are already passed to client
+type truncationLogger struct {
+	io.ReadCloser
+	logger   *logger.Logger
+	upstream *url.URL
+	logged   bool
+}
+
+func (r *truncationLogger) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if errors.Is(err, io.ErrUnexpectedEOF) && !r.logged {
+		r.logged = true
+		r.logger.Printf("Proxy error: upstream = %s, error_type = truncated, truncated upstream response\n", r.upstream.Redacted())
+	}
+	return n, err
+}
+
+// discardBody drains and closes body of response to GET sent instead of HEAD, so connection can be reused,
+// headers including Content-Length are kept as is
+func discardBody(resp *http.Response) error {
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return err
+	}
+	resp.Body.Close()
+	resp.Body = http.NoBody
+	return nil
+}
+
+// cancelOnClose releases request timeout context once response body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+func cloneResponse(to, from *http.Response) {
+	to.Status = from.Status
+	to.StatusCode = from.StatusCode
+	to.Body = from.Body
+	to.ContentLength = from.ContentLength
+	to.Trailer = from.Trailer
+	headers := []string{"Content-Length", "Content-Encoding", "Content-Type", "Location"}
+	for _, h := range headers {
+		replaceHeader(to, from, h)
+	}
+}
+
+func replaceHeader(to, from *http.Response, header string) {
+	if from.Header.Get(header) != "" {
+		to.Header.Set(header, from.Header.Get(header))
+	} else {
+		to.Header.Del(header)
+	}
+}
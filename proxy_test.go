@@ -0,0 +1,495 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+)
+
+func TestPreserveHost(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host))
+	}))
+	defer backend.Close()
+	urls := backendURLs(t, backend)
+
+	for _, tt := range []struct {
+		preserve bool
+		want     string
+	}{
+		{false, urls[0].Host},
+		{true, "public.example.com"},
+	} {
+		c := testConfig()
+		c.PreserveHost = tt.preserve
+		req := httptest.NewRequest(http.MethodGet, "http://public.example.com/", nil)
+		_, body := serve(newProxy(urls, c), req)
+		if body != tt.want {
+			t.Errorf("preserve = %v: upstream got Host %q, want %q", tt.preserve, body, tt.want)
+		}
+	}
+}
+
+// deadBackend returns URL of a closed server, so connections to it are refused
+func deadBackend() *httptest.Server {
+	s := httptest.NewServer(http.NotFoundHandler())
+	s.Close()
+	return s
+}
+
+func TestErrorResponseTemplate(t *testing.T) {
+	backend := deadBackend()
+	urls := backendURLs(t, backend)
+
+	c := testConfig()
+	c.ErrorResponseContentType = "application/json"
+	c.ErrorResponseTemplate = template.Must(template.New("error").Parse(`{"status":{{.StatusCode}},"upstream":"{{.Upstream}}"}`))
+	resp, body := serve(newProxy(urls, c), httptest.NewRequest(http.MethodGet, "/", nil))
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	if want := `{"status":502,"upstream":"` + backend.URL + `"}`; body != want {
+		t.Errorf("body = %s, want %s", body, want)
+	}
+
+	c = testConfig()
+	c.ErrorResponseBody = "plain {error}"
+	_, body = serve(newProxy(urls, c), httptest.NewRequest(http.MethodGet, "/", nil))
+	if body != "plain {error}" {
+		t.Errorf("body = %q, want plain error body as is", body)
+	}
+}
+
+func TestErrorResponseFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "502.html")
+	if err := os.WriteFile(name, []byte("<h1>Bad gateway</h1>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	body, contentType, err := readErrorResponseFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := testConfig()
+	c.ErrorResponseBody, c.ErrorResponseContentType = body, contentType
+	resp, got := serve(newProxy(backendURLs(t, deadBackend()), c), httptest.NewRequest(http.MethodGet, "/", nil))
+	if got != "<h1>Bad gateway</h1>" {
+		t.Errorf("body = %q, want file content", got)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Errorf("Content-Type = %q, want text/html; charset=utf-8", ct)
+	}
+
+	if _, _, err := readErrorResponseFile(filepath.Join(t.TempDir(), "missing.html")); err == nil {
+		t.Error("missing file is read without error")
+	}
+}
+
+func TestTimeoutAndConnectErrorCodes(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+
+	c := testConfig()
+	c.Timeout = 50 * time.Millisecond
+	c.TimeoutResponseCode = http.StatusGatewayTimeout
+	c.ConnectErrorCode = http.StatusServiceUnavailable
+
+	resp, _ := serve(newProxy(backendURLs(t, slow), c), httptest.NewRequest(http.MethodGet, "/", nil))
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("slow upstream: status = %d, want %d", resp.StatusCode, http.StatusGatewayTimeout)
+	}
+	resp, _ = serve(newProxy(backendURLs(t, deadBackend()), c), httptest.NewRequest(http.MethodGet, "/", nil))
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("dead upstream: status = %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+}
+
+func TestIndependentProxyInstances(t *testing.T) {
+	urls := backendURLs(t, deadBackend())
+	first, second := testConfig(), testConfig()
+	first.ErrorResponseCode, first.ConnectErrorCode, first.ErrorResponseBody = http.StatusBadGateway, http.StatusBadGateway, "first"
+	second.ErrorResponseCode, second.ConnectErrorCode, second.ErrorResponseBody = http.StatusServiceUnavailable, http.StatusServiceUnavailable, "second"
+	proxies := []http.Handler{newProxy(urls, first), newProxy(urls, second)}
+
+	for i, want := range []struct {
+		code int
+		body string
+	}{
+		{http.StatusBadGateway, "first"},
+		{http.StatusServiceUnavailable, "second"},
+	} {
+		resp, body := serve(proxies[i], httptest.NewRequest(http.MethodGet, "/", nil))
+		if resp.StatusCode != want.code || body != want.body {
+			t.Errorf("proxy %d: status = %d, body = %q, want %d, %q", i, resp.StatusCode, body, want.code, want.body)
+		}
+	}
+}
+
+func TestExposeUpstreamHeader(t *testing.T) {
+	first, second := namedBackend("first"), namedBackend("second")
+	defer first.Close()
+	defer second.Close()
+	hosts := map[string]string{
+		backendURLs(t, first)[0].Host:  "first",
+		backendURLs(t, second)[0].Host: "second",
+	}
+	c := testConfig()
+	c.ExposeUpstreamHeader = "X-Upstream"
+	proxy := newProxy(backendURLs(t, first, second), c)
+
+	for i := 0; i < 10; i++ {
+		resp, body := serve(proxy, httptest.NewRequest(http.MethodGet, "/", nil))
+		if name := hosts[resp.Header.Get("X-Upstream")]; name != body {
+			t.Errorf("X-Upstream = %q names %q, response is served by %q", resp.Header.Get("X-Upstream"), name, body)
+		}
+	}
+}
+
+func TestUpstreamInResponseContext(t *testing.T) {
+	backend := namedBackend("backend")
+	defer backend.Close()
+	urls := backendURLs(t, backend)
+	proxy := newProxy(urls, testConfig()).(*httputil.ReverseProxy)
+	modify := proxy.ModifyResponse
+	var got *url.URL
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		got, _ = upstreamFrom(resp.Request.Context())
+		return modify(resp)
+	}
+
+	serve(proxy, httptest.NewRequest(http.MethodGet, "/", nil))
+	if got != urls[0] {
+		t.Errorf("upstream in response context = %v, want %v", got, urls[0])
+	}
+}
+
+func TestSingleXForwardedForChain(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Join(r.Header.Values("X-Forwarded-For"), "|")))
+	}))
+	defer backend.Close()
+
+	for _, tt := range []struct {
+		mode, want string
+	}{
+		{"append", "203.0.113.7, 10.0.0.1, 192.0.2.1"},
+		{"drop", ""},
+	} {
+		c := testConfig()
+		c.XForwardedFor = tt.mode
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "192.0.2.1:5000"
+		req.Header.Add("X-Forwarded-For", "203.0.113.7")
+		req.Header.Add("X-Forwarded-For", "10.0.0.1")
+		if _, body := serve(newProxy(backendURLs(t, backend), c), req); body != tt.want {
+			t.Errorf("%s: upstream got X-Forwarded-For %q, want %q", tt.mode, body, tt.want)
+		}
+	}
+}
+
+func TestUpstreamUserAgent(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("User-Agent") + "|" + r.Header.Get("X-Original-User-Agent")))
+	}))
+	defer backend.Close()
+
+	for _, tt := range []struct {
+		agent, want string
+	}{
+		{"partner-integration/1.0", "partner-integration/1.0|curl/8.0"},
+		{"", "curl/8.0|"},
+	} {
+		c := testConfig()
+		c.UpstreamUserAgent = tt.agent
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("User-Agent", "curl/8.0")
+		if _, body := serve(newProxy(backendURLs(t, backend), c), req); body != tt.want {
+			t.Errorf("agent %q: upstream got User-Agent|X-Original-User-Agent %q, want %q", tt.agent, body, tt.want)
+		}
+	}
+}
+
+func TestViaAccumulatesBothWays(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Via", "1.1 origin-cache")
+		w.Write([]byte(r.Header.Get("Via")))
+	}))
+	defer backend.Close()
+	c := testConfig()
+	c.ViaName = "edge"
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Via", "1.0 first")
+	resp, body := serve(newProxy(backendURLs(t, backend), c), req)
+	if want := "1.0 first, 1.1 edge"; body != want {
+		t.Errorf("upstream got Via %q, want %q", body, want)
+	}
+	if got, want := resp.Header.Get("Via"), "1.1 origin-cache, 1.1 edge"; got != want {
+		t.Errorf("client got Via %q, want %q", got, want)
+	}
+}
+
+func TestOversizedHeaderRejected(t *testing.T) {
+	backend := namedBackend("backend")
+	defer backend.Close()
+	proxy := httptest.NewUnstartedServer(newProxy(backendURLs(t, backend), testConfig()))
+	proxy.Config.MaxHeaderBytes = 1 << 10
+	proxy.Start()
+	defer proxy.Close()
+
+	for _, tt := range []struct {
+		size int
+		want int
+	}{
+		{100, http.StatusOK},
+		{16 << 10, http.StatusRequestHeaderFieldsTooLarge},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, proxy.URL, nil)
+		req.Header.Set("X-Large", strings.Repeat("x", tt.size))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("header of %d bytes: status = %d, want %d", tt.size, resp.StatusCode, tt.want)
+		}
+	}
+}
+
+func TestFallbackDir(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{"index.html": "<h1>Down</h1>", "status.json": `{"status":"down"}`} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := testConfig()
+	c.FallbackDir = dir
+	proxy := newProxy(backendURLs(t, deadBackend(), deadBackend()), c)
+
+	for _, tt := range []struct {
+		path, body, contentType string
+	}{
+		{"/status.json", `{"status":"down"}`, "application/json"},
+		{"/missing", "<h1>Down</h1>", "text/html; charset=utf-8"},
+	} {
+		resp, body := serve(proxy, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if resp.StatusCode != http.StatusOK || body != tt.body || resp.Header.Get("Content-Type") != tt.contentType {
+			t.Errorf("%s: status = %d, Content-Type = %q, body = %q, want 200 with %q", tt.path, resp.StatusCode, resp.Header.Get("Content-Type"), body, tt.body)
+		}
+	}
+
+	c.FallbackDir = t.TempDir()
+	if resp, _ := serve(newProxy(backendURLs(t, deadBackend()), c), httptest.NewRequest(http.MethodGet, "/", nil)); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("empty fallback dir: status = %d, want 502", resp.StatusCode)
+	}
+}
+
+func TestRawPathKeepsEncodedSlash(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.RequestURI))
+	}))
+	defer backend.Close()
+	u, _ := url.Parse(backend.URL + "/storage")
+
+	for _, tt := range []struct {
+		raw  bool
+		want string
+	}{
+		{false, "/storage/objects/a/b.txt?v=1"},
+		{true, "/storage/objects/a%2Fb.txt?v=1"},
+	} {
+		c := testConfig()
+		c.RawPath = tt.raw
+		if _, body := serve(newProxy([]*url.URL{u}, c), httptest.NewRequest(http.MethodGet, "/objects/a%2Fb.txt?v=1", nil)); body != tt.want {
+			t.Errorf("raw path = %v: upstream got %q, want %q", tt.raw, body, tt.want)
+		}
+	}
+}
+
+func TestSynthesizeHead(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("resource body"))
+	}))
+	defer backend.Close()
+	c := testConfig()
+	c.SynthesizeHead = true
+	proxy := httptest.NewServer(newProxy(backendURLs(t, backend), c))
+	defer proxy.Close()
+
+	resp, err := http.Head(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != int64(len("resource body")) || resp.Header.Get("ETag") != `"v1"` {
+		t.Errorf("status = %d, Content-Length = %d, ETag = %q, want headers of GET response", resp.StatusCode, resp.ContentLength, resp.Header.Get("ETag"))
+	}
+	if _, body := serve(newProxy(backendURLs(t, backend), c), httptest.NewRequest(http.MethodHead, "/", nil)); len(body) > 0 {
+		t.Errorf("body = %q, want none", body)
+	}
+}
+
+func TestContentEncodingPassthrough(t *testing.T) {
+	compressed := []byte{0x0b, 0x02, 0x80, 0x68, 0x65, 0x6c, 0x6c, 0x6f, 0x03}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Accept-Encoding", r.Header.Get("Accept-Encoding"))
+		w.Header().Set("Content-Encoding", "br")
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(compressed)
+	}))
+	defer backend.Close()
+	proxy := httptest.NewServer(newProxy(backendURLs(t, backend), testConfig()))
+	defer proxy.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, proxy.URL, nil)
+	req.Header.Set("Accept-Encoding", "br")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if ae := resp.Header.Get("X-Accept-Encoding"); ae != "br" {
+		t.Errorf("upstream got Accept-Encoding %q, want br", ae)
+	}
+	if ce := resp.Header.Get("Content-Encoding"); ce != "br" || !bytes.Equal(body, compressed) {
+		t.Errorf("client got Content-Encoding %q, body %x, want br encoded body %x untouched", ce, body, compressed)
+	}
+}
+
+func TestFollowRedirectKeepsLocationOfCreated(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/old":
+			http.Redirect(w, r, "/new", http.StatusFound)
+		case "/upload":
+			http.Redirect(w, r, "/created", http.StatusSeeOther)
+		case "/created":
+			w.Header().Set("Location", "/items/7")
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("created"))
+		default:
+			w.Write([]byte("moved"))
+		}
+	}))
+	defer backend.Close()
+	c := testConfig()
+	c.FollowRedirects = true
+	proxy := newProxy(backendURLs(t, backend), c)
+
+	for _, tt := range []struct {
+		path, body, location string
+		code                 int
+	}{
+		{"/old", "moved", "", http.StatusOK},
+		{"/upload", "created", "/items/7", http.StatusCreated},
+	} {
+		resp, body := serve(proxy, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if resp.StatusCode != tt.code || body != tt.body || resp.Header.Get("Location") != tt.location {
+			t.Errorf("%s: status = %d, Location = %q, body = %q, want %d, %q, %q", tt.path, resp.StatusCode, resp.Header.Get("Location"), body, tt.code, tt.location, tt.body)
+		}
+	}
+}
+
+func TestResponseTrailers(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/stream", http.StatusFound)
+			return
+		}
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Write([]byte("streamed"))
+		w.Header().Set("X-Checksum", "abc123")
+	}))
+	defer backend.Close()
+	c := testConfig()
+	c.FollowRedirects = true
+	proxy := httptest.NewServer(newProxy(backendURLs(t, backend), c))
+	defer proxy.Close()
+
+	for _, path := range []string{"/stream", "/old"} {
+		resp, err := http.Get(proxy.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "streamed" || resp.Trailer.Get("X-Checksum") != "abc123" {
+			t.Errorf("%s: body = %q, trailer X-Checksum = %q, want upstream trailer", path, body, resp.Trailer.Get("X-Checksum"))
+		}
+	}
+}
+
+func TestPropagateDeadline(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get(deadlineHeader)))
+	}))
+	defer backend.Close()
+
+	for _, tt := range []struct {
+		timeout  time.Duration
+		min, max int
+	}{
+		{2 * time.Second, 1900, 2000},
+		{0, -1, -1},
+	} {
+		c := testConfig()
+		c.Timeout = tt.timeout
+		c.PropagateDeadline = true
+		_, body := serve(newProxy(backendURLs(t, backend), c), httptest.NewRequest(http.MethodGet, "/", nil))
+		ms := -1
+		if len(body) > 0 {
+			ms, _ = strconv.Atoi(body)
+		}
+		if ms < tt.min || ms > tt.max {
+			t.Errorf("timeout %v: upstream got %s = %q, want from %d to %d", tt.timeout, deadlineHeader, body, tt.min, tt.max)
+		}
+	}
+}
+
+func TestHideBackendHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "nginx/1.25.3")
+		w.Header().Set("X-Powered-By", "PHP/8.2")
+		w.Header().Set("X-AspNet-Version", "4.0.30319")
+		w.Header().Set("X-AspNetMvc-Version", "5.2")
+		w.Header().Set("X-Request-Id", "42")
+	}))
+	defer backend.Close()
+
+	for _, hide := range []bool{false, true} {
+		c := testConfig()
+		c.HideBackendHeaders = hide
+		resp, _ := serve(newProxy(backendURLs(t, backend), c), httptest.NewRequest(http.MethodGet, "/", nil))
+		for _, h := range []string{"Server", "X-Powered-By", "X-AspNet-Version", "X-AspNetMvc-Version"} {
+			if got := resp.Header.Get(h); (len(got) > 0) == hide {
+				t.Errorf("hide = %v: %s = %q", hide, h, got)
+			}
+		}
+		if got := resp.Header.Get("X-Request-Id"); got != "42" {
+			t.Errorf("hide = %v: X-Request-Id = %q, want other headers to remain", hide, got)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Taken from net/http/httputil/reverseproxy.go
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func parseStatuses(s string) (map[int]bool, error) {
+	statuses := make(map[int]bool)
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if len(f) == 0 {
+			continue
+		}
+		code, err := strconv.Atoi(f)
+		if err != nil {
+			return nil, err
+		}
+		statuses[code] = true
+	}
+	return statuses, nil
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// bufferBodyMiddleware reads request body up to maxBytes into memory so it can be replayed with GetBody,
+// larger bodies are passed as is
+func bufferBodyMiddleware(next http.Handler, maxBytes int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil || r.Body == http.NoBody || r.ContentLength > maxBytes {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxBytes+1))
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if int64(len(body)) > maxBytes {
+			r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+			next.ServeHTTP(w, r)
+			return
+		}
+		r.Body.Close()
+		r.ContentLength = int64(len(body))
+		r.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+		r.Body, _ = r.GetBody()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// retryOnStatus replaces response with the one from another upstream while its status is listed in RetryStatuses
+func (c *ProxyConfig) retryOnStatus(resp *http.Response, urls []*url.URL) {
+	c.retry(resp, urls, func(r *http.Response) bool {
+		return c.RetryStatuses[r.StatusCode]
+	})
+}
+
+// retryOnTruncation replaces response with the one from another upstream while upstream closes connection
+// before sending any body byte, so nothing is written to client yet
+func (c *ProxyConfig) retryOnTruncation(resp *http.Response, urls []*url.URL) {
+	c.retry(resp, urls, isTruncatedEarly)
+}
+
+// isTruncatedEarly reads the first byte of response body of known length to detect upstream closing connection
+// before sending any body, the byte is put back so the body is left readable in full
+func isTruncatedEarly(resp *http.Response) bool {
+	if resp.ContentLength <= 0 {
+		return false
+	}
+	var b [1]byte
+	n, err := io.ReadFull(resp.Body, b[:])
+	resp.Body = readCloser{io.MultiReader(bytes.NewReader(b[:n]), resp.Body), resp.Body}
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+}
+
+// retry replaces response with the one from another upstream while failed reports true for it,
+// up to Retries times or retries of matched route, on upstreams of matched route if any.
+// Idempotent requests without body and any requests with buffered body are retried,
+// other requests are not since the body is already consumed.
+func (c *ProxyConfig) retry(resp *http.Response, urls []*url.URL, failed func(*http.Response) bool) {
+	req := resp.Request
+	buffered := req.GetBody != nil
+	hasBody := req.Body != nil && req.Body != http.NoBody
+	if !buffered && (!isIdempotent(req.Method) || hasBody) {
+		return
+	}
+	path, ok := req.Context().Value(pathKey).(string)
+	if !ok {
+		return
+	}
+	rawPath, _ := req.Context().Value(rawPathKey).(string)
+
+	first, _ := upstreamFrom(req.Context())
+	tried := []*url.URL{first}
+	retries := c.retries(req.Context())
+	urls = upstreams(req.Context(), urls)
+	for attempt := 0; attempt < retries && failed(resp); attempt++ {
+		if !c.waitBeforeRetry(req.Context(), attempt) {
+			return
+		}
+		candidates := exclude(urls, tried)
+		if len(candidates) == 0 {
+			candidates = urls
+		}
+		u := c.loadBalance(candidates)
+		if u == nil {
+			return
+		}
+		tried = append(tried, u)
+
+		noteUpstream(req.Context(), u)
+		retryReq := req.Clone(context.WithValue(req.Context(), upstreamKey, u))
+		c.directTo(retryReq, u, path, rawPath)
+		if c.PropagateDeadline {
+			setDeadlineHeader(retryReq)
+		}
+		if buffered {
+			retryReq.Body, _ = req.GetBody()
+		}
+		r, err := c.Transport.RoundTrip(retryReq)
+		if err != nil {
+			c.recordResult(u, false)
+			c.Logger.Printf("Retry to %s failed: %v\n", u.Redacted(), err)
+			return
+		}
+		c.recordResult(u, r.StatusCode < http.StatusInternalServerError)
+
+		for _, h := range hopHeaders {
+			r.Header.Del(h)
+		}
+		resp.Body.Close()
+		*resp = *r
+	}
+}
+
+// resetRetryTransport retries idempotent requests once on another upstream of the pool or matched route
+// if connection was reset by upstream, i.e. when it is restarted behind L4 load balancer
+type resetRetryTransport struct {
+	c    *ProxyConfig
+	urls []*url.URL
+}
+
+func (t resetRetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if _, ok := upstreamFrom(req.Context()); !ok {
+		return nil, errNoUpstream
+	}
+	resp, err := t.c.Transport.RoundTrip(req)
+	if err == nil || !errors.Is(err, syscall.ECONNRESET) || !isIdempotent(req.Method) {
+		return resp, err
+	}
+	hasBody := req.Body != nil && req.Body != http.NoBody
+	if hasBody && req.GetBody == nil {
+		return resp, err
+	}
+	path, ok := req.Context().Value(pathKey).(string)
+	if !ok {
+		return resp, err
+	}
+	rawPath, _ := req.Context().Value(rawPathKey).(string)
+
+	first, _ := upstreamFrom(req.Context())
+	urls := upstreams(req.Context(), t.urls)
+	candidates := exclude(urls, []*url.URL{first})
+	if len(candidates) == 0 {
+		candidates = urls
+	}
+	if !t.c.waitBeforeRetry(req.Context(), 0) {
+		return resp, err
+	}
+	u := t.c.loadBalance(candidates)
+	if u == nil {
+		return resp, err
+	}
+	t.c.recordResult(first, false)
+	t.c.Logger.Printf("Connection to %s was reset, retrying to %s\n", first.Redacted(), u.Redacted())
+
+	noteUpstream(req.Context(), u)
+	retryReq := req.Clone(context.WithValue(req.Context(), upstreamKey, u))
+	t.c.directTo(retryReq, u, path, rawPath)
+	if t.c.PropagateDeadline {
+		setDeadlineHeader(retryReq)
+	}
+	if hasBody {
+		if retryReq.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	return t.c.Transport.RoundTrip(retryReq)
+}
+
+// retryDelay returns exponential backoff before retry attempt counted from zero, capped with RetryBackoffMax
+// and randomly shortened by up to RetryJitter fraction of it
+func (c *ProxyConfig) retryDelay(attempt int) time.Duration {
+	d := c.RetryBackoff << attempt
+	if d > c.RetryBackoffMax || d <= 0 {
+		d = c.RetryBackoffMax
+	}
+	return d - time.Duration(c.RetryJitter*rand.Float64()*float64(d))
+}
+
+// waitBeforeRetry sleeps for retry delay, it reports false without sleeping if the delay would exceed request deadline
+func (c *ProxyConfig) waitBeforeRetry(ctx context.Context, attempt int) bool {
+	if c.RetryBackoff <= 0 {
+		return true
+	}
+	d := c.retryDelay(attempt)
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < d {
+		return false
+	}
+	select {
+	case <-time.After(d):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// exclude returns targets not listed in excluded
+func exclude(targets, excluded []*url.URL) []*url.URL {
+	var left []*url.URL
+	for _, t := range targets {
+		found := false
+		for _, e := range excluded {
+			if t == e {
+				found = true
+				break
+			}
+		}
+		if !found {
+			left = append(left, t)
+		}
+	}
+	return left
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/unrolled/logger"
+)
+
+func TestRetryOnStatus(t *testing.T) {
+	var hits atomic.Int32
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			hits.Add(1)
+		}
+		w.Header().Set("Retry-After", "10")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("healthy"))
+	}))
+	defer healthy.Close()
+
+	c := testConfig()
+	c.Retries = 1
+	c.RetryStatuses = map[int]bool{http.StatusServiceUnavailable: true}
+
+	proxy := newProxy(backendURLs(t, unavailable, healthy), c)
+	for i := 0; i < 10; i++ {
+		resp, body := serve(proxy, httptest.NewRequest(http.MethodGet, "/", nil))
+		if resp.StatusCode != http.StatusOK || body != "healthy" {
+			t.Fatalf("GET: status = %d, body = %q, want retried response of healthy upstream", resp.StatusCode, body)
+		}
+	}
+
+	resp, _ := serve(newProxy(backendURLs(t, unavailable), c), httptest.NewRequest(http.MethodPost, "/", strings.NewReader("payload")))
+	if resp.StatusCode != http.StatusServiceUnavailable || hits.Load() != 1 {
+		t.Errorf("POST: status = %d, upstream got %d requests, want single 503 since request body can't be replayed", resp.StatusCode, hits.Load())
+	}
+}
+
+func TestRetryBufferedPost(t *testing.T) {
+	var hits atomic.Int32
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer echo.Close()
+
+	c := testConfig()
+	c.Retries = 1
+	c.RetryStatuses = map[int]bool{http.StatusServiceUnavailable: true}
+	proxy := bufferBodyMiddleware(newProxy(backendURLs(t, unavailable, echo), c), 1<<10)
+	for i := 0; i < 10; i++ {
+		resp, body := serve(proxy, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("payload")))
+		if resp.StatusCode != http.StatusOK || body != "payload" {
+			t.Fatalf("status = %d, body = %q, want body replayed to second upstream", resp.StatusCode, body)
+		}
+	}
+
+	hits.Store(0)
+	proxy = bufferBodyMiddleware(newProxy(backendURLs(t, unavailable), c), 1<<10)
+	resp, _ := serve(proxy, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Repeat("x", 2<<10))))
+	if resp.StatusCode != http.StatusServiceUnavailable || hits.Load() != 1 {
+		t.Errorf("body over limit: status = %d, upstream got %d requests, want single 503 since it isn't buffered", resp.StatusCode, hits.Load())
+	}
+}
+
+// resettingBackend resets every connection once request headers are read
+func resettingBackend() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		conn.(*net.TCPConn).SetLinger(0)
+		conn.Close()
+	}))
+}
+
+func TestRetryOnConnectionReset(t *testing.T) {
+	resetting := resettingBackend()
+	defer resetting.Close()
+	healthy := namedBackend("healthy")
+	defer healthy.Close()
+	c := testConfig()
+	proxy := newProxy(backendURLs(t, resetting, healthy), c)
+
+	for i := 0; i < 10; i++ {
+		if resp, body := serve(proxy, httptest.NewRequest(http.MethodGet, "/", nil)); resp.StatusCode != http.StatusOK || body != "healthy" {
+			t.Fatalf("GET: status = %d, body = %q, want response of healthy upstream", resp.StatusCode, body)
+		}
+	}
+	proxy = newProxy(backendURLs(t, resetting), c)
+	if resp, _ := serve(proxy, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("payload"))); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("POST: status = %d, want 502 since it isn't idempotent", resp.StatusCode)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	c := testConfig()
+	c.RetryBackoff, c.RetryBackoffMax = 10*time.Millisecond, 50*time.Millisecond
+	for attempt, want := range []time.Duration{10, 20, 40, 50, 50} {
+		if d := c.retryDelay(attempt); d != want*time.Millisecond {
+			t.Errorf("attempt %d: delay = %v, want %v", attempt, d, want*time.Millisecond)
+		}
+	}
+	c.RetryJitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := c.retryDelay(1); d < 10*time.Millisecond || d > 20*time.Millisecond {
+			t.Fatalf("jittered delay = %v, want from 10ms to 20ms", d)
+		}
+	}
+}
+
+func TestRetryBackoffGrowsWithinDeadline(t *testing.T) {
+	var mu sync.Mutex
+	var arrivals []time.Time
+	unavailable := func() *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			arrivals = append(arrivals, time.Now())
+			mu.Unlock()
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+	}
+	var servers []*httptest.Server
+	for i := 0; i < 4; i++ {
+		s := unavailable()
+		defer s.Close()
+		servers = append(servers, s)
+	}
+	c := testConfig()
+	c.Balancer = failoverBalancer{}
+	c.Retries = 3
+	c.RetryStatuses = map[int]bool{http.StatusServiceUnavailable: true}
+	c.RetryBackoff, c.RetryBackoffMax = 20*time.Millisecond, time.Second
+
+	serve(newProxy(backendURLs(t, servers...), c), httptest.NewRequest(http.MethodGet, "/", nil))
+	if len(arrivals) != 4 {
+		t.Fatalf("upstreams got %d requests, want 4", len(arrivals))
+	}
+	for i := 1; i < len(arrivals); i++ {
+		if gap, min := arrivals[i].Sub(arrivals[i-1]), c.RetryBackoff<<(i-1); gap < min {
+			t.Errorf("retry %d is sent %v after previous attempt, want at least %v", i, gap, min)
+		}
+	}
+
+	arrivals = nil
+	c.Timeout = 50 * time.Millisecond
+	start := time.Now()
+	serve(newProxy(backendURLs(t, servers...), c), httptest.NewRequest(http.MethodGet, "/", nil))
+	if d := time.Since(start); d > c.Timeout {
+		t.Errorf("request with retries took %v, want within %v timeout", d, c.Timeout)
+	}
+	if len(arrivals) >= 4 {
+		t.Errorf("upstreams got %d requests, want retries to stop before deadline", len(arrivals))
+	}
+}
+
+// truncatingBackend sends headers of response with body and closes connection before sending any body byte
+func truncatingBackend() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\n")
+		buf.Flush()
+		conn.Close()
+	}))
+}
+
+func TestRetryOnTruncatedResponse(t *testing.T) {
+	truncating := truncatingBackend()
+	defer truncating.Close()
+	healthy := namedBackend("healthy")
+	defer healthy.Close()
+
+	c := testConfig()
+	c.Balancer = failoverBalancer{}
+	c.Retries = 1
+	c.RetryTruncated = true
+	proxy := newProxy(backendURLs(t, truncating, healthy), c)
+	if resp, body := serve(proxy, httptest.NewRequest(http.MethodGet, "/", nil)); resp.StatusCode != http.StatusOK || body != "healthy" {
+		t.Errorf("status = %d, body = %q, want response of second upstream", resp.StatusCode, body)
+	}
+
+	var out bytes.Buffer
+	c = testConfig()
+	c.Balancer = failoverBalancer{}
+	c.Logger = logger.New(logger.Options{Out: &out})
+	proxy = newProxy(backendURLs(t, truncating, healthy), c)
+	if _, body := serve(proxy, httptest.NewRequest(http.MethodGet, "/", nil)); body != "" {
+		t.Errorf("body = %q without retry, want truncated response", body)
+	}
+	if !strings.Contains(out.String(), "truncated upstream response") {
+		t.Errorf("log = %q, want truncation error", out.String())
+	}
+}
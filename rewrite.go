@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type rewritePair struct {
+	from, to string
+}
+
+// parseRewritePairs parses from=to pairs
+func parseRewritePairs(rewrites []string) ([]rewritePair, error) {
+	var pairs []rewritePair
+	for _, r := range rewrites {
+		from, to, ok := strings.Cut(r, "=")
+		if !ok || len(from) == 0 {
+			return nil, fmt.Errorf("%q must be in form of from=to", r)
+		}
+		pairs = append(pairs, rewritePair{from, to})
+	}
+	return pairs, nil
+}
+
+// newBodyReplacer builds replacer out of from=to pairs
+func newBodyReplacer(rewrites []string) (*strings.Replacer, error) {
+	pairs, err := parseRewritePairs(rewrites)
+	if err != nil {
+		return nil, err
+	}
+	var oldnew []string
+	for _, p := range pairs {
+		oldnew = append(oldnew, p.from, p.to)
+	}
+	return strings.NewReplacer(oldnew...), nil
+}
+
+// isRewritable reports whether body of content type is textual, event streams are not since they are never finished
+func isRewritable(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "text/event-stream" {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || mediaType == "application/json"
+}
+
+// rewriteBody applies BodyReplacer to uncompressed textual responses not larger than BodyRewriteMaxBytes
+func (c *ProxyConfig) rewriteBody(resp *http.Response) error {
+	if len(resp.Header.Get("Content-Encoding")) > 0 || !isRewritable(resp.Header.Get("Content-Type")) {
+		return nil
+	}
+	if resp.ContentLength > c.BodyRewriteMaxBytes {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, c.BodyRewriteMaxBytes+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > c.BodyRewriteMaxBytes {
+		resp.Body = readCloser{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return nil
+	}
+	resp.Body.Close()
+
+	body = []byte(c.BodyReplacer.Replace(string(body)))
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// parseStatusRemaps parses from=to pairs where from is either a status or a class of statuses like 5xx,
+// exact statuses take precedence over classes
+func parseStatusRemaps(remaps []string) (map[int]int, error) {
+	statuses := make(map[int]int)
+	exact := make(map[int]bool)
+	for _, rm := range remaps {
+		from, to, ok := strings.Cut(rm, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q must be in form of status=status", rm)
+		}
+		code, err := strconv.Atoi(strings.TrimSpace(to))
+		if err != nil {
+			return nil, err
+		}
+		if code < 100 || code > 999 {
+			return nil, fmt.Errorf("%q has invalid status %d", rm, code)
+		}
+		from = strings.ToLower(strings.TrimSpace(from))
+		if len(from) == 3 && from[0] >= '1' && from[0] <= '5' && from[1:] == "xx" {
+			base := int(from[0]-'0') * 100
+			for s := base; s < base+100; s++ {
+				if !exact[s] {
+					statuses[s] = code
+				}
+			}
+			continue
+		}
+		s, err := strconv.Atoi(from)
+		if err != nil {
+			return nil, err
+		}
+		statuses[s] = code
+		exact[s] = true
+	}
+	return statuses, nil
+}
+
+// remapStatus replaces upstream response status with the one configured for it, body is kept
+func (c *ProxyConfig) remapStatus(resp *http.Response) {
+	code, ok := c.StatusRemaps[resp.StatusCode]
+	if !ok {
+		return
+	}
+	resp.StatusCode = code
+	resp.Status = fmt.Sprintf("%d %s", code, http.StatusText(code))
+}
+
+// modifiesBody reports whether response body may be followed, rewritten or overridden
+func (c *ProxyConfig) modifiesBody() bool {
+	return c.FollowRedirects || c.BodyReplacer != nil || len(c.OverrideBodies) > 0
+}
+
+// fitsModifyLimit reports whether response body is not larger than MaxModifyBodyBytes so it may be followed,
+// rewritten or overridden, body of unknown length is peeked at up to the limit and is left readable in full
+func (c *ProxyConfig) fitsModifyLimit(resp *http.Response) (bool, error) {
+	if c.MaxModifyBodyBytes <= 0 {
+		return true, nil
+	}
+	if resp.ContentLength >= 0 {
+		return resp.ContentLength <= c.MaxModifyBodyBytes, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, c.MaxModifyBodyBytes+1))
+	if err != nil {
+		return false, err
+	}
+	resp.Body = readCloser{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+	return int64(len(body)) <= c.MaxModifyBodyBytes, nil
+}
+
+// parseOverrideBodies parses status=body pairs
+func parseOverrideBodies(overrides []string) (map[int]string, error) {
+	bodies := make(map[int]string)
+	for _, o := range overrides {
+		status, body, ok := strings.Cut(o, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q must be in form of status=body", o)
+		}
+		code, err := strconv.Atoi(strings.TrimSpace(status))
+		if err != nil {
+			return nil, err
+		}
+		bodies[code] = body
+	}
+	return bodies, nil
+}
+
+// overrideBody replaces body of upstream response with the one configured for its status,
+// content type is application/json for JSON bodies and is detected otherwise
+func (c *ProxyConfig) overrideBody(resp *http.Response) {
+	body, ok := c.OverrideBodies[resp.StatusCode]
+	if !ok {
+		return
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(strings.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.Header.Del("Content-Encoding")
+	if json.Valid([]byte(body)) {
+		resp.Header.Set("Content-Type", "application/json")
+	} else {
+		resp.Header.Set("Content-Type", http.DetectContentType([]byte(body)))
+	}
+}
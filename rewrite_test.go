@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestBodyRewrite(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(`<a href="http://internal:8080/docs">docs</a>`))
+	}))
+	defer backend.Close()
+	c := testConfig()
+	c.BodyReplacer, _ = newBodyReplacer([]string{"http://internal:8080=https://public.example.com"})
+	c.BodyRewriteMaxBytes = 1 << 20
+
+	resp, body := serve(newProxy(backendURLs(t, backend), c), httptest.NewRequest(http.MethodGet, "/", nil))
+	if want := `<a href="https://public.example.com/docs">docs</a>`; body != want {
+		t.Errorf("body = %s, want %s", body, want)
+	}
+	if cl := resp.Header.Get("Content-Length"); cl != strconv.Itoa(len(body)) {
+		t.Errorf("Content-Length = %s, want %d", cl, len(body))
+	}
+}
+
+func TestBodyRewriteSkipsEventStream(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: http://internal:8080\n\n"))
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer backend.Close()
+	defer close(release)
+	c := testConfig()
+	c.BodyReplacer, _ = newBodyReplacer([]string{"http://internal:8080=https://public.example.com"})
+	c.BodyRewriteMaxBytes = 1 << 20
+	proxy := httptest.NewServer(newProxy(backendURLs(t, backend), c))
+	defer proxy.Close()
+
+	resp, err := http.Get(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	line := make(chan string, 1)
+	go func() {
+		s, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		line <- s
+	}()
+	select {
+	case s := <-line:
+		if s != "data: http://internal:8080\n" {
+			t.Errorf("first event line = %q, want it unchanged", s)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("event stream is buffered for rewriting")
+	}
+}
+
+func TestOverrideBody(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("<h1>Not Found</h1>"))
+	}))
+	defer backend.Close()
+	c := testConfig()
+	c.OverrideBodies, _ = parseOverrideBodies([]string{`404={"error":"not found"}`})
+
+	resp, body := serve(newProxy(backendURLs(t, backend), c), httptest.NewRequest(http.MethodGet, "/", nil))
+	if resp.StatusCode != http.StatusNotFound || body != `{"error":"not found"}` {
+		t.Errorf("status = %d, body = %s, want 404 with configured body", resp.StatusCode, body)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	if cl := resp.Header.Get("Content-Length"); cl != strconv.Itoa(len(body)) {
+		t.Errorf("Content-Length = %s, want %d", cl, len(body))
+	}
+}
+
+// firstLine reads the first line of response to GET url, it fails the test unless the line arrives within a second
+func firstLine(t *testing.T, url string) string {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	line := make(chan string, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			line <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		s, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		line <- s
+	}()
+	select {
+	case s := <-line:
+		return s
+	case <-time.After(time.Second):
+		t.Errorf("%s: first line isn't passed until upstream response is finished", url)
+		return ""
+	}
+}
+
+func TestModifyLimitStreamsUnmodifiedBodies(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/old":
+			http.Redirect(w, r, "/new", http.StatusFound)
+			return
+		case "/new":
+			w.Write([]byte("moved\n"))
+			return
+		case "/events":
+			w.Header().Set("Content-Type", "text/event-stream")
+		}
+		w.Write([]byte("data: 1\n"))
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	for _, follow := range []bool{false, true} {
+		c := testConfig()
+		c.FollowRedirects = follow
+		c.MaxModifyBodyBytes = 1 << 10
+		proxy := httptest.NewServer(newProxy(backendURLs(t, backend), c))
+		defer proxy.Close()
+
+		path := "/events"
+		if !follow {
+			path = "/stream"
+		}
+		if s := firstLine(t, proxy.URL+path); s != "data: 1\n" {
+			t.Errorf("follow = %v: first line of %s = %q", follow, path, s)
+		}
+		if follow {
+			if s := firstLine(t, proxy.URL+"/old"); s != "moved\n" {
+				t.Errorf("redirect isn't followed: first line = %q", s)
+			}
+		}
+	}
+}
+
+func TestRemapStatus(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code, _ := strconv.Atoi(r.URL.Query().Get("code"))
+		w.WriteHeader(code)
+		w.Write([]byte("upstream body"))
+	}))
+	defer backend.Close()
+	c := testConfig()
+	var err error
+	if c.StatusRemaps, err = parseStatusRemaps([]string{"418=400", "5xx=502"}); err != nil {
+		t.Fatal(err)
+	}
+	proxy := newProxy(backendURLs(t, backend), c)
+
+	for _, tt := range []struct {
+		code, want int
+	}{
+		{http.StatusTeapot, http.StatusBadRequest},
+		{http.StatusServiceUnavailable, http.StatusBadGateway},
+		{http.StatusNotFound, http.StatusNotFound},
+	} {
+		resp, body := serve(proxy, httptest.NewRequest(http.MethodGet, "/?code="+strconv.Itoa(tt.code), nil))
+		if resp.StatusCode != tt.want || body != "upstream body" {
+			t.Errorf("upstream %d: status = %d, body = %q, want %d with upstream body", tt.code, resp.StatusCode, body, tt.want)
+		}
+	}
+}
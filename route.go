@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// route sends requests with matching host and header to its own upstreams instead of the main pool,
+// non-zero timeout and error code and non-negative retries override pool wide settings for them
+type route struct {
+	name        string
+	host        string
+	hostPattern *regexp.Regexp
+	header      string
+	value       string
+	presence    bool
+	urls        []*url.URL
+	timeout     time.Duration
+	retries     int
+	errorCode   int
+}
+
+// parseRoute parses route in form of [name=api-v2,][host=api.example.com,][header=Name:value,]url=http://host[,url=...]
+// [,timeout=1m][,retries=2][,error-response-code=503], at least host or header is required.
+// Host is either exact, wildcard like *.example.com matching any subdomain or regular expression prefixed with ~
+// matching the whole host, header without value matches any request having the header.
+// Name is logged and counted for matched requests.
+func parseRoute(s string) (*route, error) {
+	r := &route{retries: -1}
+	var targets arrayFlags
+	for _, f := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(f), "=")
+		if !ok {
+			return nil, fmt.Errorf("%q must be in form of key=value", f)
+		}
+		switch key {
+		case "name":
+			r.name = value
+		case "host":
+			if strings.HasPrefix(value, "~") {
+				re, err := regexp.Compile("^(?:" + value[1:] + ")$")
+				if err != nil {
+					return nil, fmt.Errorf("%s: %v", s, err)
+				}
+				r.hostPattern = re
+			} else {
+				r.host = strings.ToLower(value)
+			}
+		case "header":
+			name, v, ok := strings.Cut(value, ":")
+			r.header, r.value, r.presence = http.CanonicalHeaderKey(strings.TrimSpace(name)), strings.TrimSpace(v), !ok
+		case "url":
+			targets = append(targets, value)
+		case "timeout":
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", s, err)
+			}
+			r.timeout = d
+		case "retries":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("%s: retries must be a non-negative number", s)
+			}
+			r.retries = n
+		case "error-response-code":
+			code, err := strconv.Atoi(value)
+			if err != nil || code < 100 || code > 999 {
+				return nil, fmt.Errorf("%s: invalid error-response-code %q", s, value)
+			}
+			r.errorCode = code
+		default:
+			return nil, fmt.Errorf("unknown route key %q", key)
+		}
+	}
+	if len(r.header) == 0 && len(r.host) == 0 && r.hostPattern == nil {
+		return nil, fmt.Errorf("%s: host or header is missing", s)
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("%s: url is missing", s)
+	}
+	var err error
+	r.urls, err = targets.toURLs()
+	return r, err
+}
+
+func (r *route) matches(req *http.Request) bool {
+	return r.matchesHost(req) && r.matchesHeader(req)
+}
+
+// exactHost reports whether route matches a single host, such routes take precedence over host patterns
+func (r *route) exactHost() bool {
+	return len(r.host) > 0 && !strings.HasPrefix(r.host, "*.")
+}
+
+func (r *route) matchesHost(req *http.Request) bool {
+	if len(r.host) == 0 && r.hostPattern == nil {
+		return true
+	}
+	host, _, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host = req.Host
+	}
+	host = strings.ToLower(host)
+	switch {
+	case r.hostPattern != nil:
+		return r.hostPattern.MatchString(host)
+	case strings.HasPrefix(r.host, "*."):
+		return strings.HasSuffix(host, r.host[1:])
+	default:
+		return host == r.host
+	}
+}
+
+func (r *route) matchesHeader(req *http.Request) bool {
+	if len(r.header) == 0 {
+		return true
+	}
+	values, ok := req.Header[r.header]
+	if !ok {
+		return false
+	}
+	if r.presence {
+		return true
+	}
+	for _, v := range values {
+		if v == r.value {
+			return true
+		}
+	}
+	return false
+}
+
+// matchRoute returns the first route matching request, routes matching host exactly take precedence over the rest
+func matchRoute(routes []*route, req *http.Request) *route {
+	var matched *route
+	for _, rt := range routes {
+		if !rt.matches(req) {
+			continue
+		}
+		if rt.exactHost() {
+			return rt
+		}
+		if matched == nil {
+			matched = rt
+		}
+	}
+	return matched
+}
+
+// routeMiddleware sends request to upstreams of the matching route, unmatched requests go to the main pool.
+// Upstream is picked among route upstreams only once request reaches the proxy, so requests served by cache
+// don't take a half-open breaker probe.
+func routeMiddleware(next http.Handler, c *ProxyConfig, routes []*route) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Value(overrideKey).(*url.URL); !ok {
+			if rt := matchRoute(routes, r); rt != nil {
+				if len(rt.name) > 0 {
+					noteRoute(r.Context(), rt.name)
+					c.Stats.routedTo(rt.name)
+				}
+				r = r.WithContext(context.WithValue(r.Context(), routeKey, rt))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// routeFrom returns route matched by request
+func routeFrom(ctx context.Context) (*route, bool) {
+	rt, ok := ctx.Value(routeKey).(*route)
+	return rt, ok
+}
+
+// timeout returns timeout of route matched by request or Timeout
+func (c *ProxyConfig) timeout(ctx context.Context) time.Duration {
+	if rt, ok := routeFrom(ctx); ok && rt.timeout > 0 {
+		return rt.timeout
+	}
+	return c.Timeout
+}
+
+// retries returns number of retries of route matched by request or Retries
+func (c *ProxyConfig) retries(ctx context.Context) int {
+	if rt, ok := routeFrom(ctx); ok && rt.retries >= 0 {
+		return rt.retries
+	}
+	return c.Retries
+}
+
+// upstreams returns upstreams of route matched by request or urls of the main pool
+func upstreams(ctx context.Context, urls []*url.URL) []*url.URL {
+	if rt, ok := routeFrom(ctx); ok {
+		return rt.urls
+	}
+	return urls
+}
+
+// pinnedTo describes upstreams request is pinned to by override, canary or route, it is empty for the main pool
+func pinnedTo(ctx context.Context) string {
+	if u, ok := ctx.Value(overrideKey).(*url.URL); ok && u != nil {
+		return u.String()
+	}
+	if rt, ok := routeFrom(ctx); ok {
+		return fmt.Sprint(rt.urls)
+	}
+	return ""
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/unrolled/logger"
+)
+
+// mustParseRoute parses route or fails the test
+func mustParseRoute(t *testing.T, s string) *route {
+	t.Helper()
+	rt, err := parseRoute(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rt
+}
+
+func TestRouteTimeoutOverride(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(150 * time.Millisecond):
+			w.Write([]byte("report"))
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	c := testConfig()
+	c.Timeout = 50 * time.Millisecond
+	urls := backendURLs(t, slow)
+	reports := mustParseRoute(t, "host=reports.example.com,url="+slow.URL+",timeout=1s")
+	proxy := routeMiddleware(newProxy(urls, c), c, []*route{reports})
+
+	req := httptest.NewRequest(http.MethodGet, "http://Reports.example.com:8080/", nil)
+	if resp, body := serve(proxy, req); resp.StatusCode != http.StatusOK || body != "report" {
+		t.Errorf("slow route: status = %d, body = %q, want response within route timeout", resp.StatusCode, body)
+	}
+	req = httptest.NewRequest(http.MethodGet, "http://api.example.com/", nil)
+	if resp, _ := serve(proxy, req); resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("default route: status = %d, want 504 after global timeout", resp.StatusCode)
+	}
+}
+
+func TestRouteRetriesAndErrorCodeOverride(t *testing.T) {
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	healthy := namedBackend("healthy")
+	defer healthy.Close()
+	closing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer closing.Close()
+
+	c := testConfig()
+	c.Retries = 1
+	c.RetryStatuses = map[int]bool{http.StatusServiceUnavailable: true}
+	urls := backendURLs(t, unavailable, healthy)
+	routes := []*route{
+		mustParseRoute(t, "host=no-retry.example.com,url="+unavailable.URL+",retries=0"),
+		mustParseRoute(t, "host=closing.example.com,url="+closing.URL+",error-response-code=503"),
+	}
+	proxy := routeMiddleware(newProxy(urls, c), c, routes)
+
+	for i := 0; i < 10; i++ {
+		if _, body := serve(proxy, httptest.NewRequest(http.MethodGet, "/", nil)); body != "healthy" {
+			t.Fatalf("default route: body = %q, want response retried with global retries", body)
+		}
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://no-retry.example.com/", nil)
+	if resp, _ := serve(proxy, req); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("route without retries: status = %d, want 503 of the route upstream", resp.StatusCode)
+	}
+	req = httptest.NewRequest(http.MethodGet, "http://closing.example.com/", nil)
+	if resp, _ := serve(proxy, req); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("route with error code: status = %d, want 503", resp.StatusCode)
+	}
+}
+
+func TestRouteRetriesOnRouteUpstreams(t *testing.T) {
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	resetting := resettingBackend()
+	defer resetting.Close()
+	pool, routed := namedBackend("main"), namedBackend("routed")
+	defer pool.Close()
+	defer routed.Close()
+
+	c := testConfig()
+	c.RetryStatuses = map[int]bool{http.StatusServiceUnavailable: true}
+	routes := []*route{
+		mustParseRoute(t, "host=unavailable.example.com,url="+unavailable.URL+",url="+routed.URL+",retries=1"),
+		mustParseRoute(t, "host=resetting.example.com,url="+resetting.URL+",url="+routed.URL),
+	}
+	proxy := routeMiddleware(newProxy(backendURLs(t, pool), c), c, routes)
+
+	for _, host := range []string{"unavailable.example.com", "resetting.example.com"} {
+		for i := 0; i < 10; i++ {
+			req := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+			if resp, body := serve(proxy, req); resp.StatusCode != http.StatusOK || body != "routed" {
+				t.Fatalf("%s: status = %d, body = %q, want retry to the route upstream", host, resp.StatusCode, body)
+			}
+		}
+	}
+}
+
+func TestParseRouteOverrides(t *testing.T) {
+	rt := mustParseRoute(t, "host=a.example.com,url=http://a:8080,timeout=2m,retries=3,error-response-code=503")
+	if rt.timeout != 2*time.Minute || rt.retries != 3 || rt.errorCode != 503 {
+		t.Errorf("overrides = %v, %d, %d, want 2m0s, 3, 503", rt.timeout, rt.retries, rt.errorCode)
+	}
+	if rt := mustParseRoute(t, "host=a.example.com,url=http://a:8080"); rt.timeout != 0 || rt.retries != -1 || rt.errorCode != 0 {
+		t.Errorf("route without overrides has %v, %d, %d", rt.timeout, rt.retries, rt.errorCode)
+	}
+	for _, s := range []string{
+		"url=http://a:8080",
+		"host=a.example.com",
+		"host=a.example.com,url=http://a:8080,timeout=soon",
+		"host=a.example.com,url=http://a:8080,retries=-1",
+		"host=a.example.com,url=http://a:8080,error-response-code=5000",
+	} {
+		if _, err := parseRoute(s); err == nil {
+			t.Errorf("%s is accepted", s)
+		}
+	}
+}
+
+func TestHostRouting(t *testing.T) {
+	backends := make(map[string]*httptest.Server)
+	for _, name := range []string{"default", "wildcard", "exact", "regex"} {
+		backends[name] = namedBackend(name)
+		defer backends[name].Close()
+	}
+	c := testConfig()
+	routes := []*route{
+		mustParseRoute(t, "host=*.api.example.com,url="+backends["wildcard"].URL),
+		mustParseRoute(t, "host=Special.api.example.com,url="+backends["exact"].URL),
+		mustParseRoute(t, `host=~tenant-[0-9]+\.example\.com,url=`+backends["regex"].URL),
+	}
+	proxy := routeMiddleware(newProxy(backendURLs(t, backends["default"]), c), c, routes)
+
+	for _, tt := range []struct {
+		host, want string
+	}{
+		{"special.api.example.com", "exact"},
+		{"a.api.example.com", "wildcard"},
+		{"a.b.api.example.com:8080", "wildcard"},
+		{"api.example.com", "default"},
+		{"tenant-42.example.com:8080", "regex"},
+		{"tenant-42.example.com.evil.com", "default"},
+		{"other.example.com", "default"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://"+tt.host+"/", nil)
+		if _, body := serve(proxy, req); body != tt.want {
+			t.Errorf("%s is routed to %s, want %s", tt.host, body, tt.want)
+		}
+	}
+
+	if _, err := parseRoute("host=~(,url=http://a:8080"); err == nil {
+		t.Error("route with invalid host expression is accepted")
+	}
+}
+
+func TestHeaderRouting(t *testing.T) {
+	v1, v2, beta := namedBackend("v1"), namedBackend("v2"), namedBackend("beta")
+	defer v1.Close()
+	defer v2.Close()
+	defer beta.Close()
+	c := testConfig()
+	proxy := routeMiddleware(newProxy(backendURLs(t, v1), c), c, []*route{
+		mustParseRoute(t, "header=X-Api-Version:2,url="+v2.URL),
+		mustParseRoute(t, "header=X-Beta,url="+beta.URL),
+	})
+
+	for _, tt := range []struct {
+		header, value, want string
+	}{
+		{"X-Api-Version", "2", "v2"},
+		{"X-Api-Version", "3", "v1"},
+		{"", "", "v1"},
+		{"X-Beta", "", "beta"},
+		{"X-Beta", "anything", "beta"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if len(tt.header) > 0 {
+			req.Header[tt.header] = []string{tt.value}
+		}
+		if _, body := serve(proxy, req); body != tt.want {
+			t.Errorf("%s: %q is served by %q, want %q", tt.header, tt.value, body, tt.want)
+		}
+	}
+}
+
+func TestWeightedBalancerWithRouteAndCanary(t *testing.T) {
+	stable, routed, canary := namedBackend("stable"), namedBackend("routed"), namedBackend("canary")
+	defer stable.Close()
+	defer routed.Close()
+	defer canary.Close()
+	urls := backendURLs(t, stable)
+	c := testConfig()
+	var err error
+	if c.Balancer, err = newWeightedBalancer(urls, "3", newLockedRand(1)); err != nil {
+		t.Fatal(err)
+	}
+	proxy := inFlightMiddleware(newProxy(urls, c), c, urls, newInFlight(10), time.Second)
+	proxy = canaryMiddleware(proxy, backendURLs(t, canary)[0], 100)
+	proxy = routeMiddleware(proxy, c, []*route{mustParseRoute(t, "header=X-Route,url="+routed.URL)})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Route", "1")
+	if _, body := serve(proxy, req); body != "routed" {
+		t.Errorf("routed request is served by %q", body)
+	}
+	if _, body := serve(proxy, httptest.NewRequest(http.MethodGet, "/", nil)); body != "canary" {
+		t.Errorf("canary request is served by %q", body)
+	}
+}
+
+func TestRouteNameLoggedAndCounted(t *testing.T) {
+	stable, beta := namedBackend("stable"), namedBackend("beta")
+	defer stable.Close()
+	defer beta.Close()
+	var out bytes.Buffer
+	setGlobal(t, &l, logger.New(logger.Options{Out: &out}))
+	c := testConfig()
+	proxy := routeMiddleware(newProxy(backendURLs(t, stable), c), c, []*route{mustParseRoute(t, "name=beta-users,header=X-Beta,url="+beta.URL)})
+	proxy = c.Stats.middleware(proxy, true)
+
+	req := httptest.NewRequest(http.MethodGet, "/matched", nil)
+	req.Header.Set("X-Beta", "1")
+	serve(proxy, req)
+	serve(proxy, httptest.NewRequest(http.MethodGet, "/default", nil))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], `"GET /matched HTTP/1.1" in = 0, out = 4 bytes, route = beta-users`) || strings.Contains(lines[1], "route") {
+		t.Errorf("log lines %q, want route name for matched request only", lines)
+	}
+	if s := c.Stats.String(); !strings.HasSuffix(s, "routes = [beta-users: 1]") {
+		t.Errorf("stats = %q, want matched route counted", s)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// shuttingDown is set as soon as shutdown signal is received so readiness probe fails
+var shuttingDown atomic.Bool
+
+// shutdownOnSignal shuts server down gracefully on SIGTERM or SIGINT waiting up to timeout for active requests,
+// readiness probe fails for delay before shutdown so load balancer stops sending new requests,
+// another signal received meanwhile closes all connections immediately
+func shutdownOnSignal(server *http.Server, delay, timeout time.Duration) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	sig := <-signals
+	shuttingDown.Store(true)
+	if delay > 0 {
+		l.Printf("Received %v, failing readiness probe for %v before shutdown\n", sig, delay)
+		select {
+		case <-time.After(delay):
+		case sig := <-signals:
+			l.Printf("Received %v before shutdown, closing connections immediately\n", sig)
+			server.Close()
+			return
+		}
+	}
+	l.Printf("Received %v, shutting down gracefully within %v\n", sig, timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Shutdown(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			l.Printf("Graceful shutdown failed: %v, closing connections\n", err)
+			server.Close()
+			return
+		}
+		l.Println("Server is shut down gracefully")
+	case sig := <-signals:
+		l.Printf("Received %v during graceful shutdown, closing connections immediately\n", sig)
+		server.Close()
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// sendShutdownSignal sends SIGTERM to the test process until shutdownOnSignal receives it
+func sendShutdownSignal(t *testing.T) {
+	t.Helper()
+	// keeps test process alive while nothing else is notified of SIGTERM
+	guard := make(chan os.Signal, 10)
+	signal.Notify(guard, syscall.SIGTERM)
+	t.Cleanup(func() {
+		signal.Stop(guard)
+		shuttingDown.Store(false)
+	})
+	for deadline := time.Now().Add(time.Second); !shuttingDown.Load(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("shutdown signal isn't received")
+		}
+		if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSecondSignalClosesConnections(t *testing.T) {
+	started := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	failed := make(chan error, 1)
+	go func() {
+		_, err := http.Get(server.URL)
+		failed <- err
+	}()
+	<-started
+
+	done := make(chan struct{})
+	go func() {
+		shutdownOnSignal(server.Config, 0, time.Minute)
+		close(done)
+	}()
+	sendShutdownSignal(t)
+	select {
+	case <-done:
+		t.Fatal("server is shut down while request is active")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("second signal doesn't close connections immediately")
+	}
+	if err := <-failed; err == nil {
+		t.Error("active request isn't interrupted by second signal")
+	}
+}
+
+func TestReadinessFailsBeforeShutdown(t *testing.T) {
+	backend := namedBackend("backend")
+	defer backend.Close()
+	urls := backendURLs(t, backend)
+	c := testConfig()
+	server := httptest.NewServer(healthMiddleware(newProxy(urls, c), c, urls, "/healthz", "/readyz"))
+	defer server.Close()
+	get := func(path string) int {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := get("/readyz"); code != http.StatusOK {
+		t.Fatalf("readiness before signal = %d, want 200", code)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		shutdownOnSignal(server.Config, 300*time.Millisecond, time.Second)
+		close(done)
+	}()
+	sendShutdownSignal(t)
+	for path, want := range map[string]int{"/readyz": http.StatusServiceUnavailable, "/healthz": http.StatusOK, "/": http.StatusOK} {
+		if code := get(path); code != want {
+			t.Errorf("%s during pre-shutdown delay = %d, want %d", path, code, want)
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("server isn't shut down after delay")
+	}
+}
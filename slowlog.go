@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// upstreamNote is filled with upstream the request is finally proxied to and name of route it matched
+type upstreamNote struct {
+	u     *url.URL
+	route string
+}
+
+// noteUpstream remembers upstream in note passed with request context if any
+func noteUpstream(ctx context.Context, u *url.URL) {
+	if note, ok := ctx.Value(noteKey).(*upstreamNote); ok {
+		note.u = u
+	}
+}
+
+// noteRoute remembers matched route name in note passed with request context if any
+func noteRoute(ctx context.Context, name string) {
+	if note, ok := ctx.Value(noteKey).(*upstreamNote); ok {
+		note.route = name
+	}
+}
+
+// withNote passes a new note with request context unless there is one already
+func withNote(r *http.Request) (*http.Request, *upstreamNote) {
+	if note, ok := r.Context().Value(noteKey).(*upstreamNote); ok {
+		return r, note
+	}
+	note := &upstreamNote{}
+	return r.WithContext(context.WithValue(r.Context(), noteKey, note)), note
+}
+
+// routeSuffix formats matched route name to be appended to log line, it is empty for unmatched requests
+func (n *upstreamNote) routeSuffix() string {
+	if len(n.route) == 0 {
+		return ""
+	}
+	return ", route = " + n.route
+}
+
+// slowLogMiddleware logs requests served longer than threshold along with their upstream
+func slowLogMiddleware(next http.Handler, threshold time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		r, note := withNote(r)
+		next.ServeHTTP(w, r)
+
+		d := time.Since(start)
+		if d < threshold {
+			return
+		}
+		upstream := "-"
+		if note.u != nil {
+			upstream = note.u.Redacted()
+		}
+		l.Printf("Slow request: (%s) \"%s %s %s\" upstream = %s, duration = %v%s\n", clientIP(r), r.Method, r.RequestURI, r.Proto, upstream, d, note.routeSuffix())
+	})
+}
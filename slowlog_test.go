@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/unrolled/logger"
+)
+
+func TestSlowLog(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}))
+	defer backend.Close()
+	var out bytes.Buffer
+	setGlobal(t, &l, logger.New(logger.Options{Out: &out}))
+	proxy := slowLogMiddleware(newProxy(backendURLs(t, backend), testConfig()), 50*time.Millisecond)
+
+	serve(proxy, httptest.NewRequest(http.MethodGet, "/fast", nil))
+	serve(proxy, httptest.NewRequest(http.MethodGet, "/slow", nil))
+	log := out.String()
+	if !strings.Contains(log, `Slow request: (192.0.2.1) "GET /slow HTTP/1.1" upstream = `+backend.URL+", duration = ") {
+		t.Errorf("log %q doesn't contain slow request with its upstream", log)
+	}
+	if strings.Contains(log, "/fast") {
+		t.Errorf("log %q contains fast request", log)
+	}
+}
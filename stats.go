@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// stats counts served requests, request and response bytes, requests proxied to every upstream
+// and requests matched every named route
+type stats struct {
+	total     atomic.Int64
+	active    atomic.Int64
+	bytesIn   atomic.Int64
+	bytesOut  atomic.Int64
+	urls      []*url.URL
+	upstreams map[*url.URL]*atomic.Int64
+	mu        sync.Mutex
+	routes    map[string]int64
+}
+
+func newStats(urls []*url.URL) *stats {
+	s := &stats{urls: urls, upstreams: make(map[*url.URL]*atomic.Int64), routes: make(map[string]int64)}
+	for _, u := range urls {
+		s.upstreams[u] = &atomic.Int64{}
+	}
+	return s
+}
+
+func (s *stats) proxiedTo(u *url.URL) {
+	if n, ok := s.upstreams[u]; ok {
+		n.Add(1)
+	}
+}
+
+func (s *stats) routedTo(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.routes[name]++
+}
+
+// middleware counts requests and bytes read from request bodies and written to responses,
+// with logBytes they are logged for every request as well
+func (s *stats) middleware(next http.Handler, logBytes bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.total.Add(1)
+		s.active.Add(1)
+		defer s.active.Add(-1)
+
+		in := &countingReader{ReadCloser: r.Body}
+		if r.Body != nil {
+			r.Body = in
+		}
+		out := &countingWriter{ResponseWriter: w}
+		r, note := withNote(r)
+		next.ServeHTTP(out, r)
+
+		s.bytesIn.Add(in.n)
+		s.bytesOut.Add(out.n)
+		if logBytes {
+			l.Printf("(%s) \"%s %s %s\" in = %d, out = %d bytes%s\n", clientIP(r), r.Method, r.RequestURI, r.Proto, in.n, out.n, note.routeSuffix())
+		}
+	})
+}
+
+func (s *stats) String() string {
+	return fmt.Sprintf("requests = %d, active = %d, bytes in = %d, bytes out = %d, upstreams = [%s], routes = [%s]",
+		s.total.Load(), s.active.Load(), s.bytesIn.Load(), s.bytesOut.Load(), s.upstreamCounts(), s.routeCounts())
+}
+
+func (s *stats) upstreamCounts() string {
+	var counts []string
+	for _, u := range s.urls {
+		counts = append(counts, fmt.Sprintf("%s: %d", u.Redacted(), s.upstreams[u].Load()))
+	}
+	return strings.Join(counts, ", ")
+}
+
+func (s *stats) routeCounts() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var counts []string
+	for name, n := range s.routes {
+		counts = append(counts, fmt.Sprintf("%s: %d", name, n))
+	}
+	sort.Strings(counts)
+	return strings.Join(counts, ", ")
+}
+
+// report logs stats summary every interval until stop is closed
+func (s *stats) report(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.Printf("Stats: %s\n", s)
+		case <-stop:
+			return
+		}
+	}
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// countingWriter counts response body bytes, it passes Flush through for streaming responses
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *countingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *countingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/unrolled/logger"
+)
+
+func TestStatsCountersAndSummary(t *testing.T) {
+	backend := namedBackend("backend")
+	defer backend.Close()
+	urls := backendURLs(t, backend)
+	c := testConfig()
+	c.Stats = newStats(urls)
+	proxy := c.Stats.middleware(newProxy(urls, c), false)
+
+	for i := 0; i < 3; i++ {
+		serve(proxy, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("ping")))
+	}
+	want := "requests = 3, active = 0, bytes in = 12, bytes out = 21, upstreams = [" + backend.URL + ": 3]"
+	if got := c.Stats.String(); !strings.HasPrefix(got, want) {
+		t.Errorf("stats = %q, want %q", got, want)
+	}
+
+	var out bytes.Buffer
+	setGlobal(t, &l, logger.New(logger.Options{Out: &out}))
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		c.Stats.report(10*time.Millisecond, stop)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+	<-done
+	if !strings.Contains(out.String(), "Stats: "+want) {
+		t.Errorf("log %q doesn't contain stats summary", out.String())
+	}
+}
+
+func TestStatsLogsByteCounts(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Write([]byte(strings.Repeat("x", 1000)))
+	}))
+	defer backend.Close()
+	var out bytes.Buffer
+	setGlobal(t, &l, logger.New(logger.Options{Out: &out}))
+	c := testConfig()
+	proxy := c.Stats.middleware(newProxy(backendURLs(t, backend), c), true)
+
+	serve(proxy, httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(strings.Repeat("y", 250))))
+	if !strings.Contains(out.String(), `"POST /upload HTTP/1.1" in = 250, out = 1000 bytes`) {
+		t.Errorf("log %q doesn't contain byte counts of request", out.String())
+	}
+	if got := c.Stats.String(); !strings.HasPrefix(got, "requests = 1, active = 0, bytes in = 250, bytes out = 1000") {
+		t.Errorf("stats = %q, want byte totals", got)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"time"
+)
+
+// streamingMiddleware replaces server write timeout with timeout for text/event-stream responses,
+// so long-lived streams aren't dropped when the server write timeout elapses, zero timeout means no deadline
+func streamingMiddleware(next http.Handler, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&streamingWriter{ResponseWriter: w, timeout: timeout}, r)
+	})
+}
+
+// streamingWriter sets write deadline once final response headers are known to be of event stream,
+// informational responses like 103 Early Hints are passed as is
+type streamingWriter struct {
+	http.ResponseWriter
+	timeout     time.Duration
+	wroteHeader bool
+}
+
+func (w *streamingWriter) WriteHeader(code int) {
+	if !w.wroteHeader && code >= http.StatusOK {
+		w.wroteHeader = true
+		if isEventStream(w.Header().Get("Content-Type")) {
+			var deadline time.Time
+			if w.timeout > 0 {
+				deadline = time.Now().Add(w.timeout)
+			}
+			if err := http.NewResponseController(w.ResponseWriter).SetWriteDeadline(deadline); err != nil {
+				l.Printf("Can't set write deadline of event stream: %v\n", err)
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *streamingWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *streamingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *streamingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// isEventStream reports whether content type is of server-sent events
+func isEventStream(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == "text/event-stream"
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEventStreamOutlivesWriteTimeoutAfterEarlyHints(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</app.js>; rel=preload; as=script")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 5; i++ {
+			w.Write([]byte("data: tick\n\n"))
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+		}
+	}))
+	defer backend.Close()
+	proxy := httptest.NewUnstartedServer(streamingMiddleware(newProxy(backendURLs(t, backend), testConfig()), 0))
+	proxy.Config.WriteTimeout = 100 * time.Millisecond
+	proxy.Start()
+	defer proxy.Close()
+
+	resp, err := http.Get(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	events := 0
+	for s := bufio.NewScanner(resp.Body); s.Scan(); {
+		if s.Text() == "data: tick" {
+			events++
+		}
+	}
+	if events != 5 {
+		t.Errorf("client got %d events, want 5 despite write timeout", events)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// placeholder matches {host} and {header:Name} in upstream path
+var placeholder = regexp.MustCompile(`\{(host|header:[^}]+)\}`)
+
+// pathPlaceholders returns distinct placeholders used in upstream paths
+func pathPlaceholders(urls []*url.URL) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, u := range urls {
+		for _, m := range placeholder.FindAllStringSubmatch(u.Path, -1) {
+			if !seen[m[1]] {
+				seen[m[1]] = true
+				names = append(names, m[1])
+			}
+		}
+	}
+	return names
+}
+
+func placeholderValue(name string, r *http.Request) string {
+	if name == "host" {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			return r.Host
+		}
+		return host
+	}
+	return r.Header.Get(strings.TrimPrefix(name, "header:"))
+}
+
+// expandPath replaces placeholders in upstream path with values resolved by templateMiddleware
+func expandPath(path string, values map[string]string) string {
+	return placeholder.ReplaceAllStringFunc(path, func(m string) string {
+		if v, ok := values[m[1:len(m)-1]]; ok {
+			return v
+		}
+		return m
+	})
+}
+
+// templateMiddleware resolves placeholders used in upstream paths out of incoming request,
+// requests missing any value or having value which is not a single path segment are rejected with 400
+func templateMiddleware(next http.Handler, names []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		values := make(map[string]string)
+		for _, name := range names {
+			v := placeholderValue(name, r)
+			if len(v) == 0 || v == "." || v == ".." || strings.Contains(v, "/") {
+				http.Error(w, fmt.Sprintf("Invalid or missing value of {%s}", name), http.StatusBadRequest)
+				return
+			}
+			values[name] = v
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), templateKey, values)))
+	})
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUpstreamPathTemplate(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer backend.Close()
+	urls, err := (&arrayFlags{backend.URL + "/buckets/{host}/{header:X-Tenant}"}).toURLs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := templateMiddleware(newProxy(urls, testConfig()), pathPlaceholders(urls))
+
+	for _, tt := range []struct {
+		tenant string
+		code   int
+		path   string
+	}{
+		{"acme", http.StatusOK, "/buckets/files.example.com/acme/report.pdf"},
+		{"", http.StatusBadRequest, ""},
+		{"..", http.StatusBadRequest, ""},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://files.example.com:8080/report.pdf", nil)
+		if len(tt.tenant) > 0 {
+			req.Header.Set("X-Tenant", tt.tenant)
+		}
+		resp, body := serve(proxy, req)
+		if resp.StatusCode != tt.code || (tt.code == http.StatusOK && body != tt.path) {
+			t.Errorf("tenant %q: status = %d, upstream path = %q, want %d, %q", tt.tenant, resp.StatusCode, body, tt.code, tt.path)
+		}
+	}
+}
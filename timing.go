@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// upstreamTimings records when upstream connection was established and first response byte was received
+type upstreamTimings struct {
+	mu           sync.Mutex
+	connectStart time.Time
+	connectDone  time.Time
+	firstByte    time.Time
+}
+
+// trace builds ClientTrace filling timings, connect time stays zero for reused connections
+func (t *upstreamTimings) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GetConn: func(string) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.connectStart = time.Now()
+			t.connectDone = t.connectStart
+		},
+		ConnectDone: func(string, string, error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.connectDone = time.Now()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.connectDone = time.Now()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if info.Reused {
+				t.connectDone = t.connectStart
+			}
+		},
+		GotFirstResponseByte: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.firstByte = time.Now()
+		},
+	}
+}
+
+// withTimingsTrace attaches upstream timings trace to context if request was initiated by timingLogMiddleware
+func withTimingsTrace(ctx context.Context) context.Context {
+	if t, ok := ctx.Value(timingsKey).(*upstreamTimings); ok {
+		return httptrace.WithClientTrace(ctx, t.trace())
+	}
+	return ctx
+}
+
+// timingLogMiddleware logs time to connect to upstream, time to first upstream response byte and total time of every request,
+// the first two are measured from the moment connection to upstream was requested
+func timingLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		t := &upstreamTimings{}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), timingsKey, t)))
+
+		total := time.Since(start)
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		var connect, firstByte time.Duration
+		if !t.connectStart.IsZero() {
+			connect = t.connectDone.Sub(t.connectStart)
+		}
+		if !t.firstByte.IsZero() {
+			firstByte = t.firstByte.Sub(t.connectStart)
+		}
+		l.Printf("(%s) \"%s %s %s\" connect = %v, first byte = %v, total = %v\n", clientIP(r), r.Method, r.RequestURI, r.Proto, connect, firstByte, total)
+	})
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/unrolled/logger"
+)
+
+func TestTimingLog(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("slow"))
+	}))
+	defer backend.Close()
+	var out bytes.Buffer
+	setGlobal(t, &l, logger.New(logger.Options{Out: &out}))
+
+	serve(timingLogMiddleware(newProxy(backendURLs(t, backend), testConfig())), httptest.NewRequest(http.MethodGet, "/", nil))
+	m := regexp.MustCompile(`"GET / HTTP/1.1" connect = (\S+), first byte = (\S+), total = (\S+)\n`).FindStringSubmatch(out.String())
+	if m == nil {
+		t.Fatalf("log %q doesn't contain timings", out.String())
+	}
+	var d [3]time.Duration
+	for i := range d {
+		var err error
+		if d[i], err = time.ParseDuration(m[i+1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	connect, firstByte, total := d[0], d[1], d[2]
+	if connect <= 0 || connect > firstByte || firstByte < 50*time.Millisecond || firstByte > total {
+		t.Errorf("connect = %v, first byte = %v, total = %v, want them ordered with first byte after 50ms", connect, firstByte, total)
+	}
+}
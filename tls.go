@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+var clientCertHeaders = []string{"X-Client-Cert-Subject", "X-Client-Cert-Verified"}
+
+// newServerTLSConfig loads server certificate and, if caFile is set, CA certificates to verify client certificates with
+func newServerTLSConfig(certFile, keyFile, caFile string, requireClientCert bool) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if len(caFile) > 0 {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if requireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return config, nil
+}
+
+// setClientCertHeaders passes subject of verified client certificate to upstream,
+// client supplied values of these headers are always dropped
+func setClientCertHeaders(in, out *http.Request) {
+	for _, h := range clientCertHeaders {
+		out.Header.Del(h)
+	}
+	if in.TLS == nil || len(in.TLS.VerifiedChains) == 0 {
+		out.Header.Set("X-Client-Cert-Verified", "NONE")
+		return
+	}
+	out.Header.Set("X-Client-Cert-Subject", in.TLS.PeerCertificates[0].Subject.String())
+	out.Header.Set("X-Client-Cert-Verified", "SUCCESS")
+}
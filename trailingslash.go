@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// trailingSlashMiddleware redirects with 308 to the path with trailing slash added (mode "add") or removed (mode "remove").
+// Root, paths with file extension, i.e. /app.js, and paths starting with // which would redirect to another host are never redirected.
+func trailingSlashMiddleware(next http.Handler, mode string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := r.URL.EscapedPath()
+		if p == "/" || strings.HasPrefix(p, "//") || len(path.Ext(strings.TrimSuffix(p, "/"))) > 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		target := p
+		switch {
+		case mode == "add" && !strings.HasSuffix(p, "/"):
+			target = p + "/"
+		case mode == "remove" && strings.HasSuffix(p, "/"):
+			target = strings.TrimRight(p, "/")
+			if len(target) == 0 {
+				target = "/"
+			}
+		}
+		if target == p {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(r.URL.RawQuery) > 0 {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrailingSlash(t *testing.T) {
+	for _, tt := range []struct {
+		mode, target, location string
+	}{
+		{"add", "/docs", "/docs/"},
+		{"add", "/docs?page=2", "/docs/?page=2"},
+		{"add", "/docs/", ""},
+		{"add", "/app.js", ""},
+		{"add", "/", ""},
+		{"add", "//evil.example.com", ""},
+		{"remove", "/docs/", "/docs"},
+		{"remove", "/docs//", "/docs"},
+		{"remove", "/docs", ""},
+		{"remove", "/", ""},
+		{"remove", "//evil.example.com/", ""},
+	} {
+		resp, _ := serve(trailingSlashMiddleware(http.NotFoundHandler(), tt.mode), httptest.NewRequest(http.MethodGet, tt.target, nil))
+		if len(tt.location) == 0 {
+			if resp.StatusCode != http.StatusNotFound {
+				t.Errorf("%s %s: status = %d, want request passed through", tt.mode, tt.target, resp.StatusCode)
+			}
+			continue
+		}
+		if resp.StatusCode != http.StatusPermanentRedirect || resp.Header.Get("Location") != tt.location {
+			t.Errorf("%s %s: status = %d, Location = %q, want 308 to %s", tt.mode, tt.target, resp.StatusCode, resp.Header.Get("Location"), tt.location)
+		}
+	}
+}
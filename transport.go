@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/proxy"
+)
+
+func newTransport() (http.RoundTripper, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConns = maxIdleConns
+	t.MaxIdleConnsPerHost = maxIdleConnsPerHost
+	t.IdleConnTimeout = idleConnTimeout
+	t.DisableKeepAlives = disableKeepAlives
+	t.ResponseHeaderTimeout = responseHeaderTimeout
+	t.ExpectContinueTimeout = expectContinueTimeout
+	// Pass Accept-Encoding and compressed bodies as is instead of requesting gzip and decoding it transparently
+	t.DisableCompression = true
+	dialer := &net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	t.DialContext = dialer.DialContext
+	if len(upstreamCAFile) > 0 {
+		pem, err := os.ReadFile(upstreamCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", upstreamCAFile)
+		}
+		t.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	if len(upstreamProxy) > 0 && len(socks5) > 0 {
+		return nil, errors.New("-upstream-proxy and -socks5 are mutually exclusive")
+	}
+	if len(upstreamProxy) > 0 {
+		u, err := url.Parse(upstreamProxy)
+		if err != nil {
+			return nil, err
+		}
+		t.Proxy = http.ProxyURL(u)
+	}
+	if len(socks5) > 0 {
+		t.Proxy = nil
+		d, err := newSOCKS5Dialer(dialer)
+		if err != nil {
+			return nil, err
+		}
+		t.DialContext = d.DialContext
+	}
+	if upstreamHTTP2 {
+		return newH2CTransport(t), nil
+	}
+	return t, nil
+}
+
+// h2cTransport speaks HTTP/2 with prior knowledge to plaintext upstreams,
+// TLS upstreams are served by underlying transport which negotiates HTTP/2 via ALPN
+type h2cTransport struct {
+	h2c *http2.Transport
+	tls *http.Transport
+}
+
+func newH2CTransport(t *http.Transport) *h2cTransport {
+	dial := t.DialContext
+	return &h2cTransport{
+		h2c: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dial(ctx, network, addr)
+			},
+		},
+		tls: t,
+	}
+}
+
+func (t *h2cTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "http" {
+		return t.h2c.RoundTrip(req)
+	}
+	return t.tls.RoundTrip(req)
+}
+
+// newSOCKS5Dialer builds dialer for -socks5 value in form of [user:pass@]host:port
+func newSOCKS5Dialer(forward *net.Dialer) (proxy.ContextDialer, error) {
+	addr := socks5
+	var auth *proxy.Auth
+	if i := strings.LastIndex(addr, "@"); i >= 0 {
+		user, password, _ := strings.Cut(addr[:i], ":")
+		auth = &proxy.Auth{User: user, Password: password}
+		addr = addr[i+1:]
+	}
+	d, err := proxy.SOCKS5("tcp", addr, auth, forward)
+	if err != nil {
+		return nil, err
+	}
+	return d.(proxy.ContextDialer), nil
+}
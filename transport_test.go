@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// trustBackend makes upstream transport trust certificate of TLS test server
+func trustBackend(t *testing.T, backend *httptest.Server) {
+	name := filepath.Join(t.TempDir(), "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw})
+	if err := os.WriteFile(name, cert, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	setGlobal(t, &upstreamCAFile, name)
+}
+
+// pipe copies data between connections in both directions until either of them is closed
+func pipe(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(a, b)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(b, a)
+		done <- struct{}{}
+	}()
+	<-done
+	a.Close()
+	b.Close()
+}
+
+func TestUpstreamProxyConnect(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("through tunnel"))
+	}))
+	defer backend.Close()
+	var tunnels atomic.Int32
+	connectProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT is expected", http.StatusMethodNotAllowed)
+			return
+		}
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		tunnels.Add(1)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		pipe(conn, upstream)
+	}))
+	defer connectProxy.Close()
+	trustBackend(t, backend)
+	setGlobal(t, &upstreamProxy, connectProxy.URL)
+
+	transport, err := newTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := testConfig()
+	c.Transport = transport
+	resp, body := serve(newProxy(backendURLs(t, backend), c), httptest.NewRequest(http.MethodGet, "/", nil))
+	if resp.StatusCode != http.StatusOK || body != "through tunnel" {
+		t.Errorf("status = %d, body = %q, want upstream response", resp.StatusCode, body)
+	}
+	if n := tunnels.Load(); n != 1 {
+		t.Errorf("%d tunnels are opened through upstream proxy, want 1", n)
+	}
+}
+
+func TestTransportPoolSizing(t *testing.T) {
+	setGlobal(t, &maxIdleConns, 10)
+	setGlobal(t, &maxIdleConnsPerHost, 5)
+	setGlobal(t, &idleConnTimeout, time.Minute)
+	transport, err := newTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := transport.(*http.Transport)
+	if tr.MaxIdleConns != 10 || tr.MaxIdleConnsPerHost != 5 || tr.IdleConnTimeout != time.Minute {
+		t.Errorf("pool settings = %d, %d, %v, want 10, 5, 1m0s", tr.MaxIdleConns, tr.MaxIdleConnsPerHost, tr.IdleConnTimeout)
+	}
+}
+
+func BenchmarkProxyIdleConnsPerHost(b *testing.B) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	u, _ := url.Parse(backend.URL)
+
+	for _, perHost := range []int{http.DefaultMaxIdleConnsPerHost, 64} {
+		b.Run(strconv.Itoa(perHost), func(b *testing.B) {
+			prev := maxIdleConnsPerHost
+			maxIdleConnsPerHost = perHost
+			defer func() { maxIdleConnsPerHost = prev }()
+			transport, err := newTransport()
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer transport.(*http.Transport).CloseIdleConnections()
+			c := testConfig()
+			c.Transport = transport
+			proxy := httptest.NewServer(newProxy([]*url.URL{u}, c))
+			defer proxy.Close()
+			client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: 64}}
+
+			b.SetParallelism(8)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					resp, err := client.Get(proxy.URL)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}
+			})
+		})
+	}
+}
+
+func TestDisableKeepAlives(t *testing.T) {
+	var addrs sync.Map
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addrs.Store(r.RemoteAddr, true)
+		w.Write([]byte(strconv.FormatBool(r.Close)))
+	}))
+	defer backend.Close()
+	setGlobal(t, &disableKeepAlives, true)
+	transport, err := newTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := testConfig()
+	c.Transport = transport
+	proxy := newProxy(backendURLs(t, backend), c)
+
+	for i := 0; i < 3; i++ {
+		if _, body := serve(proxy, httptest.NewRequest(http.MethodGet, "/", nil)); body != "true" {
+			t.Errorf("request %d is sent without Connection: close", i)
+		}
+	}
+	conns := 0
+	addrs.Range(func(_, _ any) bool {
+		conns++
+		return true
+	})
+	if conns != 3 {
+		t.Errorf("requests are sent over %d connections, want 3", conns)
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	setGlobal(t, &dialTimeout, 100*time.Millisecond)
+	transport, err := newTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := testConfig()
+	c.Transport = transport
+	// Reserved address which is not routed, so connection attempts hang until dial timeout
+	u, _ := url.Parse("http://10.255.255.1:81")
+
+	start := time.Now()
+	resp, _ := serve(newProxy([]*url.URL{u}, c), httptest.NewRequest(http.MethodGet, "/", nil))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("request failed in %v, want about dial timeout", elapsed)
+	}
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("status = %d, want 502", resp.StatusCode)
+	}
+}
+
+// socks5Stub serves SOCKS5 CONNECT without authentication and counts opened tunnels
+func socks5Stub(t *testing.T, tunnels *atomic.Int32) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				var head [4]byte
+				// Greeting: version, number of methods and methods
+				if _, err := io.ReadFull(conn, head[:2]); err != nil {
+					conn.Close()
+					return
+				}
+				io.ReadFull(conn, make([]byte, head[1]))
+				conn.Write([]byte{5, 0})
+				// Request: version, command, reserved, address type, address and port
+				if _, err := io.ReadFull(conn, head[:]); err != nil {
+					conn.Close()
+					return
+				}
+				var host string
+				switch head[3] {
+				case 1:
+					ip := make([]byte, 4)
+					io.ReadFull(conn, ip)
+					host = net.IP(ip).String()
+				case 3:
+					var n [1]byte
+					io.ReadFull(conn, n[:])
+					name := make([]byte, n[0])
+					io.ReadFull(conn, name)
+					host = string(name)
+				}
+				var port [2]byte
+				io.ReadFull(conn, port[:])
+				upstream, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))))
+				if err != nil {
+					conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+					conn.Close()
+					return
+				}
+				tunnels.Add(1)
+				conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				pipe(conn, upstream)
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestSOCKS5(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("through socks"))
+	}))
+	defer backend.Close()
+	var tunnels atomic.Int32
+	ln := socks5Stub(t, &tunnels)
+	defer ln.Close()
+	setGlobal(t, &socks5, ln.Addr().String())
+
+	transport, err := newTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := testConfig()
+	c.Transport = transport
+	resp, body := serve(newProxy(backendURLs(t, backend), c), httptest.NewRequest(http.MethodGet, "/", nil))
+	if resp.StatusCode != http.StatusOK || body != "through socks" {
+		t.Errorf("status = %d, body = %q, want upstream response", resp.StatusCode, body)
+	}
+	if n := tunnels.Load(); n != 1 {
+		t.Errorf("%d tunnels are opened through SOCKS5 proxy, want 1", n)
+	}
+}
+
+func TestUpstreamHTTP2(t *testing.T) {
+	backend := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}), &http2.Server{}))
+	defer backend.Close()
+	setGlobal(t, &upstreamHTTP2, true)
+	transport, err := newTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := testConfig()
+	c.Transport = transport
+
+	if _, body := serve(newProxy(backendURLs(t, backend), c), httptest.NewRequest(http.MethodGet, "/", nil)); body != "HTTP/2.0" {
+		t.Errorf("upstream got request over %s, want HTTP/2.0", body)
+	}
+}
+
+func TestMixedSchemePool(t *testing.T) {
+	plain := namedBackend("plain")
+	defer plain.Close()
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secure"))
+	}))
+	defer secure.Close()
+	trustBackend(t, secure)
+	transport, err := newTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := testConfig()
+	c.Transport = transport
+	proxy := newProxy(backendURLs(t, plain, secure), c)
+
+	served := make(map[string]int)
+	for i := 0; i < 20; i++ {
+		resp, body := serve(proxy, httptest.NewRequest(http.MethodGet, "/", nil))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, body = %q", resp.StatusCode, body)
+		}
+		served[body]++
+	}
+	if served["plain"] == 0 || served["secure"] == 0 {
+		t.Errorf("requests are served by %v, want both upstreams", served)
+	}
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	slowHeaders := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer slowHeaders.Close()
+	setGlobal(t, &responseHeaderTimeout, 50*time.Millisecond)
+	transport, err := newTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := testConfig()
+	c.Transport = transport
+
+	start := time.Now()
+	resp, _ := serve(newProxy(backendURLs(t, slowHeaders), c), httptest.NewRequest(http.MethodGet, "/", nil))
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("status = %d, want 504", resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("request failed in %v, want about response header timeout", elapsed)
+	}
+}
+
+func TestExpectContinueRelayed(t *testing.T) {
+	var upstreamExpect atomic.Value
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamExpect.Store(r.Header.Get("Expect"))
+		body, _ := io.ReadAll(r.Body)
+		w.Write([]byte(strconv.Itoa(len(body))))
+	}))
+	defer backend.Close()
+	setGlobal(t, &expectContinueTimeout, 5*time.Second)
+	transport, err := newTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := testConfig()
+	c.Transport = transport
+	proxy := httptest.NewServer(newProxy(backendURLs(t, backend), c))
+	defer proxy.Close()
+
+	var continued atomic.Bool
+	ctx := httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{
+		Got100Continue: func() { continued.Store(true) },
+	})
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPut, proxy.URL, strings.NewReader(strings.Repeat("x", 1<<20)))
+	req.Header.Set("Expect", "100-continue")
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 5 * time.Second}}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != strconv.Itoa(1<<20) || !continued.Load() {
+		t.Errorf("upstream got %s bytes, client got 100 Continue = %v, want whole body sent after 100 Continue", body, continued.Load())
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("upload took %v, want body sent without waiting for expect continue timeout", d)
+	}
+	if e, _ := upstreamExpect.Load().(string); e != "100-continue" {
+		t.Errorf("upstream got Expect %q, want 100-continue", e)
+	}
+}
@@ -0,0 +1,14 @@
+package main
+
+import "net/http"
+
+// maxURIBytesMiddleware responds with 414 to requests with request URI longer than max bytes
+func maxURIBytesMiddleware(next http.Handler, max int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.RequestURI) > max {
+			http.Error(w, http.StatusText(http.StatusRequestURITooLong), http.StatusRequestURITooLong)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
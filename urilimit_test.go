@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMaxURIBytes(t *testing.T) {
+	backend := namedBackend("backend")
+	defer backend.Close()
+	proxy := maxURIBytesMiddleware(newProxy(backendURLs(t, backend), testConfig()), 64)
+
+	for _, tt := range []struct {
+		uri  string
+		want int
+	}{
+		{"/search?q=" + strings.Repeat("a", 54), http.StatusOK},
+		{"/search?q=" + strings.Repeat("a", 55), http.StatusRequestURITooLong},
+	} {
+		if resp, _ := serve(proxy, httptest.NewRequest(http.MethodGet, tt.uri, nil)); resp.StatusCode != tt.want {
+			t.Errorf("URI of %d bytes: status = %d, want %d", len(tt.uri), resp.StatusCode, tt.want)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// websocketAccept returns Sec-WebSocket-Accept for Sec-WebSocket-Key
+func websocketAccept(key string) string {
+	h := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// websocketEchoBackend accepts upgrade to chat.v2 subprotocol with offered extensions and echoes bytes back after delay,
+// upgrade requests which don't offer chat.v2 or lack X-Session are rejected
+func websocketEchoBackend(delay time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" || r.Header.Get("Sec-WebSocket-Protocol") != "chat.v1, chat.v2" || r.Header.Get("X-Session") != "s1" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+		rw.WriteString("Sec-WebSocket-Accept: " + websocketAccept(r.Header.Get("Sec-WebSocket-Key")) + "\r\n")
+		rw.WriteString("Sec-WebSocket-Protocol: chat.v2\r\n")
+		rw.WriteString("Sec-WebSocket-Extensions: " + r.Header.Get("Sec-WebSocket-Extensions") + "\r\n\r\n")
+		rw.Flush()
+		time.Sleep(delay)
+		io.Copy(conn, rw)
+	}))
+}
+
+func TestWebSocketSubprotocol(t *testing.T) {
+	backend := websocketEchoBackend(100 * time.Millisecond)
+	defer backend.Close()
+	c := testConfig()
+	c.Timeout = 50 * time.Millisecond
+	proxy := httptest.NewServer(newProxy(backendURLs(t, backend), c))
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	req, _ := http.NewRequest(http.MethodGet, proxy.URL+"/chat", nil)
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+	req.Header = http.Header{
+		"Connection":               {"Upgrade"},
+		"Upgrade":                  {"websocket"},
+		"Sec-Websocket-Version":    {"13"},
+		"Sec-Websocket-Key":        {key},
+		"Sec-Websocket-Protocol":   {"chat.v1, chat.v2"},
+		"Sec-Websocket-Extensions": {"permessage-deflate; client_max_window_bits"},
+		"X-Session":                {"s1"},
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want 101", resp.StatusCode)
+	}
+	for h, want := range map[string]string{
+		"Sec-WebSocket-Accept":     websocketAccept(key),
+		"Sec-WebSocket-Protocol":   "chat.v2",
+		"Sec-WebSocket-Extensions": "permessage-deflate; client_max_window_bits",
+	} {
+		if got := resp.Header.Get(h); got != want {
+			t.Errorf("%s = %q, want %q", h, got, want)
+		}
+	}
+
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	echo := make([]byte, 4)
+	if _, err := io.ReadFull(br, echo); err != nil || string(echo) != "ping" {
+		t.Errorf("echo = %q, err = %v, want ping passed after proxy timeout", echo, err)
+	}
+}